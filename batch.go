@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const defaultBatchWorkers = 2
+
+// batchDir holds a directory per input of a batch with its outputs and
+// report, inputs of the same package would overwrite each other otherwise.
+const batchDir = "batch"
+
+// deviceMu serializes the device stages of the runs of a batch, the workers
+// share the device and the emulator.
+var deviceMu sync.Mutex
+
+// batchResult is the outcome of one APK of a batch.
+type batchResult struct {
+	Input  string
+	Report *runReport
+	Err    error
+}
+
+// collectBatchInputs expands directories, glob patterns and manifest files
+// into the list of APKs to patch. A manifest is a text file with one APK path
+// per line, relative paths are resolved against the manifest's directory.
+func collectBatchInputs(args []string) ([]string, error) {
+	inputs := []string{}
+	for _, arg := range args {
+		if strings.ContainsAny(arg, "*?[") {
+			matches, err := filepath.Glob(arg)
+			if err != nil {
+				return nil, err
+			}
+			// 和目录一样只取 APK 文件，通配符也会匹配到清单等其他文件
+			for _, match := range matches {
+				if stat, err := os.Stat(match); err == nil && !stat.IsDir() && isInputFile(match) {
+					inputs = append(inputs, match)
+				}
+			}
+			continue
+		}
+		stat, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case stat.IsDir():
+			entries, err := os.ReadDir(arg)
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range entries {
+				if !entry.IsDir() && isInputFile(entry.Name()) {
+					inputs = append(inputs, filepath.Join(arg, entry.Name()))
+				}
+			}
+		case isInputFile(arg):
+			inputs = append(inputs, filepath.Clean(arg))
+		default:
+			listed, err := readBatchManifest(arg)
+			if err != nil {
+				return nil, err
+			}
+			inputs = append(inputs, listed...)
+		}
+	}
+	sort.Strings(inputs)
+	return uniqueStrings(inputs), nil
+}
+
+func readBatchManifest(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	inputs := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(filepath.Dir(path), line)
+		}
+		inputs = append(inputs, line)
+	}
+	return inputs, scanner.Err()
+}
+
+// runBatch patches every input with a pool of workers. A failing APK does not
+// stop the batch, onDone is called as each APK finishes.
+func runBatch(ctx context.Context, inputs []string, base patchOptions, workers int, onDone func(batchResult)) []batchResult {
+	if workers < 1 {
+		workers = 1
+	}
+	results := make([]batchResult, len(inputs))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	var doneMu sync.Mutex
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				opts := base
+				opts.APKFile = inputs[i]
+				opts.WorkDir = filepath.Join("output", fmt.Sprintf("batch-%03d", i))
+				opts.OutputDir = batchOutputDir(i, inputs[i])
+				report, err := modifyAPK(ctx, opts)
+				os.RemoveAll(opts.WorkDir)
+				results[i] = batchResult{Input: inputs[i], Report: report, Err: err}
+				if onDone != nil {
+					doneMu.Lock()
+					onDone(results[i])
+					doneMu.Unlock()
+				}
+			}
+		}()
+	}
+	for i := range inputs {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return results
+}
+
+// batchOutputDir is named after the position and the file name of the input.
+func batchOutputDir(index int, input string) string {
+	name := strings.TrimSuffix(filepath.Base(input), filepath.Ext(input))
+	return filepath.Join(batchDir, fmt.Sprintf("%03d-%s", index+1, name))
+}
+
+func printBatchSummary(w io.Writer, results []batchResult) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "APK\tPACKAGE\tSTATUS\tSTAGE\tDURATION\tREPORT")
+	failed := 0
+	for _, result := range results {
+		status, stage := "ok", ""
+		if result.Err != nil {
+			status, stage = "failed", result.Report.FailedStage
+			failed++
+		}
+		duration := result.Report.FinishedAt.Sub(result.Report.StartedAt).Round(time.Second)
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", filepath.Base(result.Input), result.Report.Package, status, stage, duration, result.Report.ReportPath)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\n%s\n", T("batchSummary", Args{"ok": len(results) - failed, "count": len(results)}))
+}
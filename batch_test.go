@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestBatchOutputDirsAreDistinct(t *testing.T) {
+	inputs := []string{"a/app.apk", "b/app.apk", "b/app.xapk", "c/other.apks"}
+	want := []string{"001-app", "002-app", "003-app", "004-other"}
+	for i, input := range inputs {
+		if got := batchOutputDir(i, input); got != filepath.Join(batchDir, want[i]) {
+			t.Errorf("batchOutputDir(%d, %q) = %q, want %q", i, input, got, filepath.Join(batchDir, want[i]))
+		}
+	}
+}
+
+// writeBatchTree creates APKs, other files and a manifest listing APKs
+// relative to itself, absolute and with comments.
+func writeBatchTree(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	files := map[string]string{
+		"apps/a.apk":          "",
+		"apps/b.xapk":         "",
+		"apps/notes.txt":      "",
+		"apps/list.json":      "",
+		"apps/dir.apk/c.apk":  "",
+		"other/d.APKS":        "",
+		"lists/manifest.txt":  "# apps of the release\n../apps/a.apk\n\n  c.apk  \n" + filepath.Join(dir, "other", "d.APKS") + "\n",
+		"lists/duplicate.txt": "../apps/b.xapk\n../apps/./b.xapk\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestCollectBatchInputs(t *testing.T) {
+	dir := writeBatchTree(t)
+	p := func(name string) string { return filepath.Join(dir, filepath.FromSlash(name)) }
+	for _, test := range []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{"directory", []string{p("apps")}, []string{p("apps/a.apk"), p("apps/b.xapk")}},
+		{"glob", []string{p("apps/*")}, []string{p("apps/a.apk"), p("apps/b.xapk")}},
+		{"glob of directories", []string{p("*/*.apk")}, []string{p("apps/a.apk")}},
+		{"file", []string{p("other/d.APKS")}, []string{p("other/d.APKS")}},
+		{"manifest", []string{p("lists/manifest.txt")}, []string{p("apps/a.apk"), p("lists/c.apk"), p("other/d.APKS")}},
+		{"duplicates", []string{p("apps"), p("apps/*.apk"), p("apps/./a.apk"), p("lists/manifest.txt"), p("lists/duplicate.txt")},
+			[]string{p("apps/a.apk"), p("apps/b.xapk"), p("lists/c.apk"), p("other/d.APKS")}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := collectBatchInputs(test.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("collectBatchInputs(%q) = %q, want %q", test.args, got, test.want)
+			}
+		})
+	}
+	if _, err := collectBatchInputs([]string{p("missing")}); err == nil {
+		t.Error("missing input: no error")
+	}
+}
+
+func TestReadBatchManifest(t *testing.T) {
+	dir := writeBatchTree(t)
+	p := func(name string) string { return filepath.Join(dir, filepath.FromSlash(name)) }
+	for _, test := range []struct {
+		manifest string
+		want     []string
+	}{
+		{"lists/manifest.txt", []string{p("apps/a.apk"), p("lists/c.apk"), p("other/d.APKS")}},
+		{"lists/duplicate.txt", []string{p("apps/b.xapk"), p("apps/b.xapk")}},
+	} {
+		got, err := readBatchManifest(p(test.manifest))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("readBatchManifest(%q) = %q, want %q", test.manifest, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// APKs extracted from .apks/.xapk bundles are stored below this directory.
+const bundlesDir = "bundles"
+
+// inputExtensions are the file types accepted as input.
+var inputExtensions = []string{".apk", ".apks", ".xapk"}
+
+func isInputFile(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, e := range inputExtensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// isBundleFile tells whether the file is a split APK bundle (.apks or .xapk).
+func isBundleFile(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".apks" || ext == ".xapk"
+}
+
+// extractBundle unpacks the APKs of a bundle into destDir and returns their
+// paths, base APK first.
+func extractBundle(bundlePath, destDir string) ([]string, error) {
+	r, err := zip.OpenReader(bundlePath)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	os.RemoveAll(destDir)
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return nil, err
+	}
+	apks := []string{}
+	sizes := make(map[string]uint64)
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() || !strings.EqualFold(filepath.Ext(f.Name), ".apk") {
+			continue
+		}
+		// flatten the paths, .apks files keep their splits in a splits/ folder
+		dest := filepath.Join(destDir, strings.ReplaceAll(filepath.ToSlash(f.Name), "/", "_"))
+		if err := extractZipFile(f, dest); err != nil {
+			return nil, err
+		}
+		apks = append(apks, dest)
+		sizes[dest] = f.UncompressedSize64
+	}
+	if len(apks) == 0 {
+		return nil, fmt.Errorf("no APK found in %s", bundlePath)
+	}
+	sort.Strings(apks)
+
+	base := ""
+	for _, apk := range apks {
+		name := strings.ToLower(filepath.Base(apk))
+		if name == "base.apk" || strings.HasSuffix(name, "base-master.apk") {
+			base = apk
+			break
+		}
+	}
+	// xapk files name the base APK after the package, it is the biggest one
+	if base == "" {
+		for _, apk := range apks {
+			if strings.Contains(filepath.Base(apk), "config.") {
+				continue
+			}
+			if base == "" || sizes[apk] > sizes[base] {
+				base = apk
+			}
+		}
+	}
+	if base == "" {
+		base = apks[0]
+	}
+	result := []string{base}
+	for _, apk := range apks {
+		if apk != base {
+			result = append(result, apk)
+		}
+	}
+	slog.Info("Extracted bundle", "bundle", bundlePath, "apks", result)
+	return result, nil
+}
+
+func extractZipFile(f *zip.File, dest string) error {
+	src, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, src)
+	return err
+}
+
+// isSignatureFile tells whether a zip entry belongs to the v1 signature,
+// MANIFEST.MF also carries the X-Android-APK-Signed marker of Play.
+func isSignatureFile(name string) bool {
+	if !strings.HasPrefix(name, "META-INF/") || strings.Count(name, "/") != 1 {
+		return false
+	}
+	upper := strings.ToUpper(name)
+	if upper == "META-INF/MANIFEST.MF" {
+		return true
+	}
+	switch filepath.Ext(upper) {
+	case ".SF", ".RSA", ".EC", ".DSA":
+		return true
+	}
+	return false
+}
+
+// stripSignature copies the APK without its v1 signature files. The v2 block
+// is dropped as well, it is not a zip entry. The entries are copied without
+// recompressing them, resources.arsc has to stay stored.
+func stripSignature(src, dest string) error {
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	zw := zip.NewWriter(out)
+	for _, f := range r.File {
+		if isSignatureFile(f.Name) {
+			continue
+		}
+		if err = zw.Copy(f); err != nil {
+			break
+		}
+	}
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dest)
+	}
+	return err
+}
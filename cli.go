@@ -0,0 +1,925 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// exit codes of the command line, stage failures use stageExitCodes
+const (
+	exitOK           = 0
+	exitFailure      = 1
+	exitUsage        = 2
+	exitDependencies = 3
+	// exitBatchFailed is returned when some APKs of a batch failed
+	exitBatchFailed = 4
+)
+
+var stageExitCodes = map[string]int{
+	stageDecode:  10,
+	stagePatch:   11,
+	stageBuild:   12,
+	stageSign:    13,
+	stageDevice:  20,
+	stageInstall: 21,
+	stageLaunch:  22,
+}
+
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	var se *stageError
+	if errors.As(err, &se) {
+		if code, ok := stageExitCodes[se.Stage]; ok {
+			return code
+		}
+	}
+	return exitFailure
+}
+
+type cliCommand struct {
+	name           string
+	descriptionKey string
+	run            func(args []string) int
+}
+
+func cliCommands() []cliCommand {
+	return []cliCommand{
+		{"patch", "cmdPatch", runPatchCommand},
+		{"batch", "cmdBatch", runBatchCommand},
+		{"sign", "cmdSign", runSignCommand},
+		{"install", "cmdInstall", runInstallCommand},
+		{"inspect", "cmdInspect", runInspectCommand},
+		{"devices", "cmdDevices", runDevicesCommand},
+		{"profile", "cmdProfile", runProfileCommand},
+		{"config", "cmdConfig", runConfigCommand},
+		{"i18n", "cmdI18n", runI18nCommand},
+		{"diag", "cmdDiag", runDiagCommand},
+		{"doctor", "cmdDoctor", runDoctorCommand},
+		{"tools", "cmdTools", runToolsCommand},
+		{"gui", "cmdGUI", func(args []string) int {
+			runGUI()
+			return exitOK
+		}},
+	}
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, T("usage"))
+	fmt.Fprintln(w)
+	for _, c := range cliCommands() {
+		fmt.Fprintf(w, "  %-10s %s\n", c.name, T(c.descriptionKey))
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, T("logLocation", Args{"path": logFilePath()}))
+}
+
+// runCLI runs a subcommand and returns the process exit code.
+func runCLI(args []string) int {
+	profile, args, err := extractProfileFlag(args)
+	if err != nil {
+		return cliFail(exitUsage, err)
+	}
+	if profile != "" {
+		if err := setProfileFlag(profile); err != nil {
+			return cliFail(exitUsage, err)
+		}
+	}
+	if len(args) == 0 {
+		runGUI()
+		return exitOK
+	}
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		printUsage(os.Stdout)
+		return exitOK
+	}
+	for _, c := range cliCommands() {
+		if c.name == args[0] {
+			return c.run(args[1:])
+		}
+	}
+	fmt.Fprintln(os.Stderr, T("unknownCommand", Args{"command": args[0]}))
+	fmt.Fprintln(os.Stderr)
+	printUsage(os.Stderr)
+	return exitUsage
+}
+
+// extractProfileFlag removes --profile from the arguments, it is handled
+// before the subcommand flags are bound to the profile and may be given
+// anywhere on the command line.
+func extractProfileFlag(args []string) (string, []string, error) {
+	profile := ""
+	rest := []string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			return profile, append(rest, args[i:]...), nil
+		case arg == "-profile" || arg == "--profile":
+			if i+1 >= len(args) {
+				return "", nil, errors.New("flag needs an argument: -profile")
+			}
+			profile = args[i+1]
+			i++
+		case strings.HasPrefix(arg, "-profile=") || strings.HasPrefix(arg, "--profile="):
+			profile = arg[strings.Index(arg, "=")+1:]
+		default:
+			rest = append(rest, arg)
+		}
+	}
+	return profile, rest, nil
+}
+
+// cliFail reports an error on stderr and in the log file.
+func cliFail(code int, err error) int {
+	slog.Error("Command failed", "code", code, "error", err)
+	fmt.Fprintln(os.Stderr, T("error", Args{"error": err}))
+	return code
+}
+
+// stringListFlag is a comma separated flag bound to a string slice.
+type stringListFlag struct {
+	values *[]string
+}
+
+func (f stringListFlag) String() string {
+	if f.values == nil {
+		return ""
+	}
+	return strings.Join(*f.values, ",")
+}
+
+func (f stringListFlag) Set(value string) error {
+	*f.values = uniqueStrings(strings.Split(value, ","))
+	return nil
+}
+
+// logcatLevelFlag refuses levels logcat does not know.
+type logcatLevelFlag struct {
+	level *string
+}
+
+func (f logcatLevelFlag) String() string {
+	if f.level == nil {
+		return ""
+	}
+	return *f.level
+}
+
+func (f logcatLevelFlag) Set(value string) error {
+	if _, err := parseLogcatLevel(value); err != nil {
+		return err
+	}
+	*f.level = value
+	return nil
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "apicker %s\n", name)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// flagSettings maps the flags of addPatchFlags and addDeviceFlags to the
+// settings they override.
+var flagSettings = map[string]string{
+	"domain":                     "domains",
+	"ca":                         "caFiles",
+	"skipUserCAs":                "patch.skipUserCAs",
+	"disableCleartext":           "patch.disableCleartext",
+	"debuggable":                 "patch.debuggable",
+	"keystore":                   "keystore",
+	"keyAlias":                   "keyAlias",
+	"dname":                      "dname",
+	"avd":                        "emulator.avd",
+	"systemCA":                   "emulator.systemCA",
+	"rootEmulator":               "emulator.root",
+	"keepEmulator":               "emulator.keepRunning",
+	"grant":                      "postInstall.grantPermissions",
+	"grantDangerous":             "postInstall.grantDangerous",
+	"disableBatteryOptimization": "postInstall.disableBatteryOptimization",
+	"logcat":                     "logcat.enabled",
+	"logcatTags":                 "logcat.tags",
+	"logcatLevel":                "logcat.level",
+	"skipLaunchVerify":           "launch.skipVerify",
+	"launchWait":                 "launch.waitSeconds",
+}
+
+// addPatchFlags binds the patch and signing options, opts holds the values of
+// the active profile which are used as defaults.
+func addPatchFlags(fs *flag.FlagSet, opts *patchOptions) {
+	fs.StringVar(&opts.Domain, "domain", opts.Domain, T("domain"))
+	fs.Var(stringListFlag{&opts.CAFiles}, "ca", T("caFiles"))
+	fs.BoolVar(&opts.Patch.SkipUserCAs, "skipUserCAs", opts.Patch.SkipUserCAs, T("skipUserCAs"))
+	fs.BoolVar(&opts.Patch.DisableCleartext, "disableCleartext", opts.Patch.DisableCleartext, T("disableCleartext"))
+	fs.BoolVar(&opts.Patch.Debuggable, "debuggable", opts.Patch.Debuggable, T("debuggable"))
+	addSigningFlags(fs, opts)
+}
+
+func addSigningFlags(fs *flag.FlagSet, opts *patchOptions) {
+	fs.StringVar(&opts.Keystore, "keystore", opts.Keystore, T("keystorePath"))
+	fs.StringVar(&opts.KeystorePassword, "keystorePassword", opts.KeystorePassword, T("keystorePassword"))
+	fs.StringVar(&opts.KeyAlias, "keyAlias", opts.KeyAlias, T("keyAlias"))
+	fs.StringVar(&opts.KeyPassword, "keyPassword", opts.KeyPassword, T("keyPassword"))
+	fs.StringVar(&opts.DName, "dname", opts.DName, T("dname"))
+}
+
+// addDeviceFlags binds the device related options to a copy of the profile,
+// so the flags default to the values saved in the config file without
+// changing them. The copy becomes runProfile.
+func addDeviceFlags(fs *flag.FlagSet) *Profile {
+	p := new(Profile)
+	*p = *config.profile()
+	runProfile = p
+	fs.StringVar(&p.Emulator.AVD, "avd", p.Emulator.AVD, T("avd"))
+	fs.StringVar(&p.Emulator.SystemCA, "systemCA", p.Emulator.SystemCA, T("systemCA"))
+	fs.BoolVar(&p.Emulator.Root, "rootEmulator", p.Emulator.Root, T("rootEmulator"))
+	fs.BoolVar(&p.Emulator.KeepRunning, "keepEmulator", p.Emulator.KeepRunning, T("keepEmulator"))
+	fs.Var(stringListFlag{&p.PostInstall.GrantPermissions}, "grant", T("grantPermissions"))
+	fs.BoolVar(&p.PostInstall.GrantDangerous, "grantDangerous", p.PostInstall.GrantDangerous, T("grantDangerous"))
+	fs.BoolVar(&p.PostInstall.DisableBatteryOptimization, "disableBatteryOptimization", p.PostInstall.DisableBatteryOptimization, T("disableBatteryOptimization"))
+	fs.BoolVar(&p.Logcat.Enabled, "logcat", p.Logcat.Enabled, T("streamLogcat"))
+	fs.Var(stringListFlag{&p.Logcat.Tags}, "logcatTags", T("logcatTags"))
+	fs.Var(logcatLevelFlag{&p.Logcat.Level}, "logcatLevel", T("logcatLevel"))
+	fs.BoolVar(&p.Launch.SkipVerify, "skipLaunchVerify", p.Launch.SkipVerify, T("skipLaunchVerify"))
+	fs.IntVar(&p.Launch.WaitSeconds, "launchWait", p.Launch.WaitSeconds, T("launchWait"))
+	return p
+}
+
+// cliContext is cancelled by Ctrl+C, which kills the running child processes.
+func cliContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt)
+}
+
+// finishDeviceRun keeps streaming logcat until Ctrl+C or until the app exits,
+// then shuts down the emulators started by this run.
+func finishDeviceRun() {
+	activeLogcatMu.Lock()
+	stream := activeLogcat
+	activeLogcatMu.Unlock()
+	if stream != nil {
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt)
+		select {
+		case <-interrupt:
+		case <-stream.Done():
+		}
+		signal.Stop(interrupt)
+		stopLogcat()
+	}
+	if !runningProfile().Emulator.KeepRunning {
+		shutdownStartedEmulators()
+	}
+}
+
+func runPatchCommand(args []string) int {
+	fs := newFlagSet("patch")
+	opts := config.profile().patchOptions()
+	fs.StringVar(&opts.APKFile, "apk", "", T("apkFilePath"))
+	addPatchFlags(fs, &opts)
+	fromDevice := fs.String("from-device", "", T("fromDevicePackage"))
+	rerun := fs.String("rerun", "", T("rerunPackage"))
+	deviceProfile := addDeviceFlags(fs)
+	saveProfile := fs.Bool("saveProfile", false, T("saveProfile"))
+	jsonOutput := fs.Bool("json", false, T("jsonOutput"))
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if *rerun != "" {
+		recent, ok := findRecentInput(*rerun)
+		if !ok {
+			return cliFail(exitUsage, errors.New(T("noRecentInput", Args{"package": *rerun})))
+		}
+		applyRecentInput(fs, &opts, recent)
+	}
+	if opts.APKFile == "" && fs.NArg() > 0 {
+		opts.APKFile = fs.Arg(0)
+	}
+	if opts.APKFile == "" && *fromDevice == "" {
+		fs.Usage()
+		return exitUsage
+	}
+	if *saveProfile {
+		config.profile().setPatchOptions(opts)
+		config.profile().setDeviceOptions(deviceProfile)
+		if err := saveConfig(); err != nil {
+			slog.Error("Error saving config", "error", err)
+		}
+	}
+
+	needed := patchTools(opts)
+	if *fromDevice != "" {
+		needed = append(needed, "adb")
+	}
+	if missing := missingTools(needed); len(missing) > 0 {
+		return cliFail(exitDependencies, missingToolsError(missing))
+	}
+
+	if *fromDevice != "" {
+		device, err := getConnectedDevice()
+		if err != nil || device == "" {
+			return cliFail(stageExitCodes[stageDevice], errors.New(T("noDevice")))
+		}
+		apks, err := pullPackage(device, *fromDevice, filepath.Join(pulledDir, *fromDevice))
+		if err != nil {
+			return cliFail(stageExitCodes[stageDevice], err)
+		}
+		opts.APKFile, opts.SplitAPKs = apks[0], apks[1:]
+	}
+
+	ctx, stop := cliContext()
+	report, err := modifyAPK(ctx, opts)
+	stop()
+	if err := addRecentInput(opts, report.Package); err != nil {
+		slog.Error("Error saving recent input", "error", err)
+	}
+	printReport(report, *jsonOutput)
+	if err != nil {
+		shutdownStartedEmulators()
+		return cliFail(exitCode(err), err)
+	}
+	finishDeviceRun()
+	return exitOK
+}
+
+// applyRecentInput applies the options of a recent run after fs was parsed,
+// the flags given on the command line are set again so they still win. A
+// file given as argument replaces the remembered input.
+func applyRecentInput(fs *flag.FlagSet, opts *patchOptions, recent RecentInput) {
+	given := map[string]string{}
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = f.Value.String()
+	})
+	recent.apply(opts)
+	for name, value := range given {
+		fs.Set(name, value)
+	}
+	if _, ok := given["apk"]; !ok && fs.NArg() > 0 {
+		opts.APKFile = fs.Arg(0)
+	}
+	// the remembered split APKs belong to the remembered input
+	if opts.APKFile != recent.Path {
+		opts.SplitAPKs = nil
+	}
+}
+
+// printReport prints the whole report with -json, otherwise only where the
+// outputs went.
+func printReport(report *runReport, jsonOutput bool) {
+	if jsonOutput {
+		report.writeJSON(os.Stdout)
+		return
+	}
+	for _, output := range report.Outputs {
+		fmt.Println(output)
+	}
+	if report.ReportPath != "" {
+		fmt.Println(report.ReportPath)
+	}
+}
+
+func runBatchCommand(args []string) int {
+	fs := newFlagSet("batch")
+	opts := config.profile().patchOptions()
+	addPatchFlags(fs, &opts)
+	addDeviceFlags(fs)
+	workers := fs.Int("workers", defaultBatchWorkers, T("batchWorkers"))
+	install := fs.Bool("install", false, T("batchInstall"))
+	jsonOutput := fs.Bool("json", false, T("jsonOutput"))
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	inputs, err := collectBatchInputs(fs.Args())
+	if err != nil {
+		return cliFail(exitUsage, err)
+	}
+	if len(inputs) == 0 {
+		fmt.Fprintln(fs.Output(), "apicker batch [flags] <dir|glob|list.txt|file.apk>...")
+		fs.PrintDefaults()
+		return exitUsage
+	}
+
+	needed := requiredTools()
+	for _, input := range inputs {
+		needed = patchTools(patchOptions{APKFile: input}, needed...)
+	}
+	if *install {
+		needed = append(needed, "adb")
+	}
+	if missing := missingTools(needed); len(missing) > 0 {
+		return cliFail(exitDependencies, missingToolsError(missing))
+	}
+	ctx, stop := cliContext()
+	defer stop()
+	// the keystore is shared by all workers, create it before they start
+	if err := ensureKeystore(ctx, opts); err != nil {
+		return cliFail(stageExitCodes[stageSign], err)
+	}
+	// a single logcat stream can not follow several apps, and the emulator has
+	// to stay up until the last APK is done
+	runProfile.Logcat.Enabled = false
+	keepEmulator := runProfile.Emulator.KeepRunning
+	runProfile.Emulator.KeepRunning = true
+	opts.SkipInstall = !*install
+
+	results := runBatch(ctx, inputs, opts, *workers, func(result batchResult) {
+		if result.Err != nil {
+			fmt.Fprintf(os.Stderr, "FAIL %s: %v\n", result.Input, result.Err)
+		} else {
+			fmt.Fprintf(os.Stderr, "OK   %s\n", result.Input)
+		}
+	})
+	if !keepEmulator {
+		shutdownStartedEmulators()
+	}
+
+	if *jsonOutput {
+		reports := []*runReport{}
+		for _, result := range results {
+			reports = append(reports, result.Report)
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(reports)
+	} else {
+		printBatchSummary(os.Stdout, results)
+	}
+	for _, result := range results {
+		if result.Err != nil {
+			return exitBatchFailed
+		}
+	}
+	return exitOK
+}
+
+func runSignCommand(args []string) int {
+	fs := newFlagSet("sign")
+	opts := config.profile().patchOptions()
+	addSigningFlags(fs, &opts)
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() < 1 {
+		fmt.Fprintln(fs.Output(), "apicker sign [flags] <input.apk> [output.apk]")
+		fs.PrintDefaults()
+		return exitUsage
+	}
+	input := fs.Arg(0)
+	output := filepath.Join(filepath.Dir(input), "signed_"+filepath.Base(input))
+	if fs.NArg() > 1 {
+		output = fs.Arg(1)
+	}
+	if missing := missingTools(withAlternatives([]string{"keytool", "jarsigner"})); len(missing) > 0 {
+		return cliFail(exitDependencies, missingToolsError(missing))
+	}
+	ctx, stop := cliContext()
+	defer stop()
+	if err := ensureKeystore(ctx, opts); err != nil {
+		return cliFail(stageExitCodes[stageSign], err)
+	}
+	if err := signAPK(ctx, opts, input, output); err != nil {
+		return cliFail(stageExitCodes[stageSign], err)
+	}
+	fmt.Println(output)
+	return exitOK
+}
+
+func runInstallCommand(args []string) int {
+	fs := newFlagSet("install")
+	serial := fs.String("s", "", T("deviceSerial"))
+	addDeviceFlags(fs)
+	jsonOutput := fs.Bool("json", false, T("jsonOutput"))
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() < 1 {
+		fmt.Fprintln(fs.Output(), "apicker install [flags] <base.apk> [split.apk...]")
+		fs.PrintDefaults()
+		return exitUsage
+	}
+	if missing := missingTools([]string{"apktool", "java", "adb"}); len(missing) > 0 {
+		return cliFail(exitDependencies, missingToolsError(missing))
+	}
+	report := newRunReport(fs.Arg(0))
+	report.SplitAPKs = fs.Args()[1:]
+	ctx, stop := cliContext()
+	err := installAPKFiles(ctx, report, *serial, fs.Args())
+	stop()
+	report.finish(err)
+	if saveErr := report.save(); saveErr != nil {
+		slog.Error("Error saving report", "error", saveErr)
+	}
+	printReport(report, *jsonOutput)
+	if err != nil {
+		shutdownStartedEmulators()
+		return cliFail(exitCode(err), err)
+	}
+	finishDeviceRun()
+	return exitOK
+}
+
+func installAPKFiles(ctx context.Context, report *runReport, device string, apks []string) error {
+	report.startStage(stageDecode)
+	info, err := inspectAPK(ctx, apks[0])
+	if err != nil {
+		return stageFailed(stageDecode, err)
+	}
+	report.setAPKInfo(info)
+	if device == "" {
+		report.startStage(stageDevice)
+		device, err = getTargetDevice(ctx)
+		if err == nil && device == "" {
+			err = errors.New(T("noDevice"))
+		}
+		if err != nil {
+			return stageFailed(stageDevice, err)
+		}
+	}
+	return deployAPK(ctx, report, device, info.manifest(), apks)
+}
+
+func runInspectCommand(args []string) int {
+	fs := newFlagSet("inspect")
+	jsonOutput := fs.Bool("json", false, T("jsonOutput"))
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(fs.Output(), "apicker inspect <file.apk>")
+		return exitUsage
+	}
+	if missing := missingTools([]string{"apktool", "java"}); len(missing) > 0 {
+		return cliFail(exitDependencies, missingToolsError(missing))
+	}
+	ctx, stop := cliContext()
+	defer stop()
+	info, err := inspectAPK(ctx, fs.Arg(0))
+	if err != nil {
+		return cliFail(stageExitCodes[stageDecode], err)
+	}
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(info)
+		return exitOK
+	}
+	printAPKInfo(os.Stdout, info)
+	return exitOK
+}
+
+func printAPKInfo(w io.Writer, info *apkInfo) {
+	fmt.Fprintf(w, "%-24s %s\n", "App name:", info.AppName)
+	fmt.Fprintf(w, "%-24s %s\n", "Package:", info.Package)
+	fmt.Fprintf(w, "%-24s %s (%s)\n", "Version:", info.VersionName, info.VersionCode)
+	fmt.Fprintf(w, "%-24s %s / %s\n", "Min / target SDK:", info.MinSDK, info.TargetSDK)
+	fmt.Fprintf(w, "%-24s %s\n", "Main activity:", info.MainActivity)
+	fmt.Fprintf(w, "%-24s %s\n", "ABIs:", strings.Join(info.ABIs, ", "))
+	fmt.Fprintf(w, "%-24s %s\n", "Network security config:", info.NetworkSecurityConfig)
+	fmt.Fprintf(w, "%-24s %s\n", "Pinning libraries:", strings.Join(info.PinningLibraries, ", "))
+	fmt.Fprintf(w, "%-24s\n", "Signers:")
+	for _, signer := range info.Signers {
+		fmt.Fprintf(w, "  %s\n    SHA-256 %s\n", signer.Subject, signer.SHA256)
+	}
+	fmt.Fprintf(w, "%-24s\n", "Permissions:")
+	for _, p := range info.Permissions {
+		fmt.Fprintf(w, "  %s\n", p)
+	}
+	if info.NetworkSecurityConfigXML != "" {
+		fmt.Fprintf(w, "\n%s\n", info.NetworkSecurityConfigXML)
+	}
+}
+
+func runDevicesCommand(args []string) int {
+	fs := newFlagSet("devices")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	output, err := toolCommand("adb", "devices", "-l").Output()
+	if err != nil {
+		return cliFail(stageExitCodes[stageDevice], err)
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "List of devices") {
+			fmt.Println(line)
+		}
+	}
+	avds, err := listAVDs()
+	if err != nil {
+		slog.Warn("Error listing AVDs", "error", err)
+	}
+	for _, avd := range avds {
+		fmt.Printf("%s avd\n", avd)
+	}
+	return exitOK
+}
+
+// runProfileCommand lists, selects, shows, imports and exports profiles.
+func runProfileCommand(args []string) int {
+	fs := newFlagSet("profile")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "apicker profile list|use <name>|show [name]|export <name> <file>|import <file> [name]")
+	}
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	args = fs.Args()
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+	switch {
+	case args[0] == "list":
+		active := config.profile()
+		for _, name := range config.profileNames() {
+			marker := " "
+			if config.Profiles[name] == active {
+				marker = "*"
+			}
+			fmt.Printf("%s %s\n", marker, name)
+		}
+	case args[0] == "use" && len(args) == 2:
+		if err := config.useProfile(args[1]); err != nil {
+			return cliFail(exitUsage, err)
+		}
+		if err := saveConfig(); err != nil {
+			return cliFail(exitFailure, err)
+		}
+	case args[0] == "show" && len(args) <= 2:
+		config.profile()
+		name := config.ActiveProfile
+		if len(args) == 2 {
+			name = args[1]
+		}
+		content, err := marshalProfile(name)
+		if err != nil {
+			return cliFail(exitUsage, err)
+		}
+		os.Stdout.Write(content)
+	case args[0] == "export" && len(args) == 3:
+		config.profile()
+		if err := exportProfile(args[1], args[2]); err != nil {
+			return cliFail(exitFailure, err)
+		}
+	case args[0] == "import" && (len(args) == 2 || len(args) == 3):
+		name := ""
+		if len(args) == 3 {
+			name = args[2]
+		}
+		name, err := importProfile(args[1], name)
+		if err != nil {
+			return cliFail(exitFailure, err)
+		}
+		fmt.Println(name)
+	default:
+		fs.Usage()
+		return exitUsage
+	}
+	return exitOK
+}
+
+// runConfigCommand prints the effective settings and the layer each one came
+// from, the flags of patch are accepted to see their effect.
+func runConfigCommand(args []string) int {
+	if len(args) == 0 || args[0] != "show" {
+		fmt.Fprintln(os.Stderr, "apicker config show [flags] [file.apk]")
+		return exitUsage
+	}
+	fs := newFlagSet("config show")
+	opts := config.profile().patchOptions()
+	addPatchFlags(fs, &opts)
+	deviceProfile := addDeviceFlags(fs)
+	if err := fs.Parse(args[1:]); err != nil {
+		return exitUsage
+	}
+	sources := make(map[string]string, len(configSources))
+	for key, source := range configSources {
+		sources[key] = source
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if key, ok := flagSettings[f.Name]; ok {
+			sources[key] = sourceFlag + " -" + f.Name
+		}
+	})
+	// the profile is only changed to show the values, it is not saved
+	config.profile().setPatchOptions(opts)
+	config.profile().setDeviceOptions(deviceProfile)
+	values := currentSettings()
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tVALUE\tSOURCE")
+	for _, key := range sortedSettingKeys() {
+		source := sources[key]
+		switch source {
+		case "":
+			source = sourceDefault
+		case sourceUser:
+			source = sourceUser + " " + getConfigFilePath()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", key, formatSetting(values[key]), source)
+	}
+	tw.Flush()
+	return exitOK
+}
+
+// runI18nCommand reports the translation keys missing or extra in each
+// language compared to en.yaml, it fails when a language is incomplete. list
+// shows the languages and the translation packs of the user.
+func runI18nCommand(args []string) int {
+	if len(args) != 1 || (args[0] != "check" && args[0] != "list") {
+		fmt.Fprintln(os.Stderr, "apicker i18n check|list")
+		return exitUsage
+	}
+	if args[0] == "list" {
+		packs := make(map[string]translationPack)
+		for _, pack := range translationPacks {
+			packs[pack.Language] = pack
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "LANGUAGE\tNAME\tSOURCE")
+		for _, tag := range availableLanguages() {
+			source := "built-in"
+			if pack, ok := packs[tag]; ok {
+				source = pack.Path
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", tag, languageName(tag), source)
+		}
+		tw.Flush()
+		for _, pack := range translationPacks {
+			for _, warning := range pack.Warnings {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", pack.Path, warning)
+			}
+		}
+		return exitOK
+	}
+	if !printTranslationIssues(os.Stdout, checkTranslations(translations)) {
+		return exitFailure
+	}
+	return exitOK
+}
+
+// runDiagCommand zips the diagnostics of a run, given by its report or run
+// ID, the newest run of the working directory by default.
+func runDiagCommand(args []string) int {
+	fs := newFlagSet("diag")
+	output := fs.String("o", "", T("diagOutput"))
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() > 1 {
+		fmt.Fprintln(fs.Output(), "apicker diag [-o file.zip] [report.json|run ID]")
+		return exitUsage
+	}
+	reportPath, err := findReport(fs.Arg(0))
+	if err != nil {
+		return cliFail(exitFailure, err)
+	}
+	report, err := readReport(reportPath)
+	if err != nil {
+		return cliFail(exitFailure, err)
+	}
+	if *output == "" {
+		*output = defaultDiagPath(report)
+	}
+	ctx, stop := cliContext()
+	defer stop()
+	if err := writeDiagnostics(ctx, reportPath, *output); err != nil {
+		return cliFail(exitFailure, err)
+	}
+	fmt.Println(T("diagnosticsSaved", Args{"path": *output}))
+	return exitOK
+}
+
+// runDoctorCommand checks the external tools and tells how to fix the ones
+// that are missing or too old, it fails when a required tool can not be run.
+func runDoctorCommand(args []string) int {
+	fs := newFlagSet("doctor")
+	jsonOutput := fs.Bool("json", false, T("jsonOutput"))
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	ctx, stop := cliContext()
+	checks := runDoctor(ctx)
+	stop()
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(checks)
+	} else {
+		printToolChecks(os.Stdout, checks)
+	}
+	for _, check := range checks {
+		if check.Required && check.failed() {
+			return exitDependencies
+		}
+	}
+	return exitOK
+}
+
+func printToolChecks(w io.Writer, checks []toolCheck) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TOOL\tNEEDED\tSTATUS\tVERSION\tPATH")
+	for _, check := range checks {
+		path := check.Path
+		if check.Source != "" && check.Source != "PATH" {
+			path += " (" + check.Source + ")"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", check.Name, check.neededText(), check.statusText(), check.Version, path)
+	}
+	tw.Flush()
+	for _, check := range checks {
+		if !check.needsFix() {
+			continue
+		}
+		fmt.Fprintf(w, "\n%s: %s\n", check.Name, check.statusText())
+		if check.Error != "" {
+			fmt.Fprintf(w, "  %s\n", check.Error)
+		}
+		fmt.Fprintf(w, "  %s\n", T("toolFix_"+check.Name))
+		if isFetchable(check.Name) {
+			fmt.Fprintf(w, "  %s\n", T("toolFetchHint"))
+		}
+	}
+}
+
+// runToolsCommand lists the tools apicker can download, puts them into the
+// cache, from the network or a bundle directory, and records their checksums.
+func runToolsCommand(args []string) int {
+	usage := "apicker tools list|fetch [--from dir] [--bundle dir [--all-platforms]] [name...]|pin [toolpins.yaml]"
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+	fs := newFlagSet("tools " + args[0])
+	from := fs.String("from", os.Getenv("APICKER_TOOLS_BUNDLE"), T("toolsFrom"))
+	bundle := fs.String("bundle", "", T("toolsBundle"))
+	allPlatforms := fs.Bool("all-platforms", false, T("toolsAllPlatforms"))
+	if err := fs.Parse(args[1:]); err != nil {
+		return exitUsage
+	}
+	progress := func(message string) {
+		fmt.Fprintln(os.Stderr, message)
+	}
+	ctx, stop := cliContext()
+	defer stop()
+	switch args[0] {
+	case "list":
+		pins, err := loadToolPins()
+		if err != nil {
+			return cliFail(exitFailure, err)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tVERSION\tTOOLS\tSTATUS")
+		for _, pin := range pins {
+			tools := []string{}
+			for tool := range pin.Provides {
+				tools = append(tools, tool)
+			}
+			sort.Strings(tools)
+			status := T("toolNotFetched")
+			if pin.installed() {
+				status = pin.dir()
+			} else if _, ok := pin.download(); !ok {
+				status = T("noToolDownload", Args{"name": pin.Name, "platform": runtime.GOOS + "/" + runtime.GOARCH})
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", pin.Name, pin.Version, strings.Join(tools, ", "), status)
+		}
+		tw.Flush()
+	case "fetch":
+		var err error
+		if *bundle != "" {
+			err = bundleTools(ctx, fs.Args(), *bundle, *allPlatforms, progress)
+		} else {
+			err = fetchTools(ctx, fs.Args(), *from, progress)
+		}
+		if err != nil {
+			return cliFail(exitFailure, err)
+		}
+	case "pin":
+		path := "toolpins.yaml"
+		if fs.NArg() > 0 {
+			path = fs.Arg(0)
+		}
+		if err := pinToolChecksums(ctx, path, progress); err != nil {
+			return cliFail(exitFailure, err)
+		}
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		return exitUsage
+	}
+	return exitOK
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const defaultProfileName = "default"
+
+type Config struct {
+	// Version is the format of the file, see configVersion
+	Version  int    `yaml:"version"`
+	Language string `yaml:"language"`
+	// Font is the path or file name of a .ttf or .otf font for the GUI, a CJK
+	// font of the system is used when empty
+	Font string `yaml:"font,omitempty"`
+	// Tools are explicit paths of the external tools
+	Tools         ToolPaths           `yaml:"tools,omitempty"`
+	ActiveProfile string              `yaml:"activeProfile,omitempty"`
+	Profiles      map[string]*Profile `yaml:"profiles,omitempty"`
+	Recent        []RecentInput       `yaml:"recent,omitempty"`
+	// LegacyProfile is the single profile of older config files, it is moved
+	// to Profiles when the config is loaded
+	LegacyProfile *Profile `yaml:"profile,omitempty"`
+}
+
+// Profile groups the options that are reused between runs, the config file
+// holds several named profiles which can be shared with import and export.
+type Profile struct {
+	Domains     []string           `yaml:"domains,omitempty"`
+	CAFiles     []string           `yaml:"caFiles,omitempty"`
+	Patch       PatchSettings      `yaml:"patch,omitempty"`
+	Keystore    string             `yaml:"keystore,omitempty"`
+	KeyAlias    string             `yaml:"keyAlias,omitempty"`
+	DName       string             `yaml:"dname,omitempty"`
+	PostInstall PostInstallOptions `yaml:"postInstall,omitempty"`
+	Launch      LaunchOptions      `yaml:"launch,omitempty"`
+	Logcat      LogcatOptions      `yaml:"logcat,omitempty"`
+	Emulator    EmulatorOptions    `yaml:"emulator,omitempty"`
+}
+
+// ToolPaths are the paths of the external tools, an empty path means the
+// tool is looked up in JAVA_HOME, the Android SDK and the PATH. apktool may be
+// given as apktool.jar, it is then run with java.
+type ToolPaths struct {
+	Apktool   string `yaml:"apktool,omitempty"`
+	Java      string `yaml:"java,omitempty"`
+	Keytool   string `yaml:"keytool,omitempty"`
+	Jarsigner string `yaml:"jarsigner,omitempty"`
+	Adb       string `yaml:"adb,omitempty"`
+	Apksigner string `yaml:"apksigner,omitempty"`
+	Zipalign  string `yaml:"zipalign,omitempty"`
+	Emulator  string `yaml:"emulator,omitempty"`
+}
+
+// PatchSettings toggles the changes made to the APK besides trusting the CA
+// files of the profile.
+type PatchSettings struct {
+	// SkipUserCAs stops trusting the CAs installed by the user
+	SkipUserCAs bool `yaml:"skipUserCAs,omitempty"`
+	// DisableCleartext keeps cleartext traffic forbidden
+	DisableCleartext bool `yaml:"disableCleartext,omitempty"`
+	// Debuggable marks the application as debuggable
+	Debuggable bool `yaml:"debuggable,omitempty"`
+}
+
+// profileFile is the format of exported profiles.
+type profileFile struct {
+	Name    string `yaml:"name"`
+	Profile `yaml:",inline"`
+}
+
+func getConfigFilePath() string {
+	homeDir, _ := os.UserHomeDir()
+	configDir := filepath.Join(homeDir, ".config")
+	if _, err := os.Stat(configDir); os.IsNotExist(err) {
+		os.Mkdir(configDir, 0755)
+	}
+	return filepath.Join(configDir, "apicker.yml")
+}
+
+var config Config
+
+// configReadOnly is set when the config file could not be used, it is then
+// left untouched instead of being overwritten with the defaults.
+var configReadOnly bool
+
+// configLoadError is the error of loadConfig, shown once the GUI is up.
+var configLoadError error
+
+// loadConfig reads the config file, migrates it when it was written by an
+// older version and validates it. On error the defaults are used.
+func loadConfig() (err error) {
+	configFilePath := getConfigFilePath()
+
+	if _, err = os.Stat(configFilePath); os.IsNotExist(err) {
+		return nil
+	}
+	defer func() {
+		if err != nil {
+			config = Config{}
+			configReadOnly = true
+			err = fmt.Errorf("%s: %v", configFilePath, err)
+			configLoadError = err
+		}
+	}()
+
+	content, err := ioutil.ReadFile(configFilePath)
+	if err != nil {
+		return
+	}
+	loaded, fileVersion, err := decodeConfig(content)
+	if err != nil {
+		return
+	}
+	config = loaded
+
+	if fileVersion < configVersion {
+		backup, err := backupConfig(configFilePath, content, fileVersion)
+		if err != nil {
+			return err
+		}
+		slog.Info("Migrated config, the previous file is kept", "backup", backup)
+		if err := saveConfig(); err != nil {
+			slog.Error("Error saving migrated config", "error", err)
+		}
+	}
+	return nil
+}
+
+// decodeConfig parses the content of a config file and migrates it to the
+// current version, it also returns the version the file was written with.
+func decodeConfig(content []byte) (Config, int, error) {
+	var loaded Config
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&loaded); err != nil && err != io.EOF {
+		return Config{}, 0, err
+	}
+	if loaded.Version == 0 {
+		loaded.Version = 1
+	}
+	if loaded.Version > configVersion {
+		return Config{}, 0, fmt.Errorf("written by a newer version of apicker (version %d, supported %d)", loaded.Version, configVersion)
+	}
+	fileVersion := loaded.Version
+	if fileVersion < configVersion {
+		if err := migrateConfig(&loaded); err != nil {
+			return Config{}, 0, err
+		}
+	}
+	if err := loaded.validate(); err != nil {
+		return Config{}, 0, err
+	}
+	return loaded, fileVersion, nil
+}
+
+// saveConfig writes the config file, settings that come from the project
+// config or the environment are not written. The file is replaced at once so
+// a crash can not leave it truncated.
+func saveConfig() error {
+	if configReadOnly {
+		slog.Warn("Not saving config, the config file could not be loaded")
+		return nil
+	}
+	return writeConfig(userConfig())
+}
+
+// saveRecentInputs writes config.Recent into the config file as it is on
+// disk, the options changed in memory for a run are not saved with it.
+func saveRecentInputs() error {
+	if configReadOnly {
+		slog.Warn("Not saving config, the config file could not be loaded")
+		return nil
+	}
+	saved := Config{}
+	content, err := ioutil.ReadFile(getConfigFilePath())
+	if err == nil {
+		saved, _, err = decodeConfig(content)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	saved.Recent = config.Recent
+	return writeConfig(saved)
+}
+
+func writeConfig(saved Config) error {
+	saved.Version = configVersion
+	if err := saved.validate(); err != nil {
+		return err
+	}
+	content, err := yaml.Marshal(&saved)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(getConfigFilePath(), content, 0644)
+}
+
+// writeFileAtomic writes to a temporary file next to path and renames it over
+// path.
+func writeFileAtomic(path string, content []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// profile returns the active profile, it is created when missing.
+func (c *Config) profile() *Profile {
+	if c.ActiveProfile == "" {
+		c.ActiveProfile = defaultProfileName
+	}
+	if c.Profiles == nil {
+		c.Profiles = make(map[string]*Profile)
+	}
+	p, ok := c.Profiles[c.ActiveProfile]
+	if !ok {
+		p = &Profile{}
+		c.Profiles[c.ActiveProfile] = p
+	}
+	return p
+}
+
+// profileNames returns the names of the profiles, sorted.
+func (c *Config) profileNames() []string {
+	c.profile()
+	names := make([]string, 0, len(c.Profiles))
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// useProfile makes the named profile the active one of the user config.
+func (c *Config) useProfile(name string) error {
+	if _, ok := c.Profiles[name]; !ok {
+		return errors.New(T("unknownProfile", Args{"name": name}))
+	}
+	*c = userConfig()
+	configOverrides, configUserValues = nil, nil
+	c.ActiveProfile = name
+	applyConfigLayers()
+	return nil
+}
+
+// setProfileFlag selects the profile for this run only, as --profile does.
+func setProfileFlag(name string) error {
+	if _, ok := config.Profiles[name]; !ok {
+		return errors.New(T("unknownProfile", Args{"name": name}))
+	}
+	profileFlag = name
+	applyConfigLayers()
+	return nil
+}
+
+// patchOptions returns the options of a run with the profile, settings the
+// profile leaves empty use the defaults.
+func (p *Profile) patchOptions() patchOptions {
+	opts := patchOptions{
+		Domain:           strings.Join(p.Domains, ","),
+		CAFiles:          p.CAFiles,
+		Patch:            p.Patch,
+		Keystore:         p.Keystore,
+		KeystorePassword: defaultKeyStorePassword,
+		KeyAlias:         p.KeyAlias,
+		KeyPassword:      defaultKeyPassword,
+		DName:            p.DName,
+	}
+	if opts.Keystore == "" {
+		opts.Keystore = defaultKeyStore
+	}
+	if opts.KeyAlias == "" {
+		opts.KeyAlias = defaultKeyAlias
+	}
+	if opts.DName == "" {
+		opts.DName = defaultDName
+	}
+	return opts
+}
+
+// setPatchOptions stores the options of a run in the profile, passwords are
+// not stored.
+func (p *Profile) setPatchOptions(opts patchOptions) {
+	p.Domains = splitDomains(opts.Domain)
+	p.CAFiles = opts.CAFiles
+	p.Patch = opts.Patch
+	p.Keystore = opts.Keystore
+	p.KeyAlias = opts.KeyAlias
+	p.DName = opts.DName
+}
+
+// setDeviceOptions copies the device related options of from, the ones bound
+// by the device flags.
+func (p *Profile) setDeviceOptions(from *Profile) {
+	p.PostInstall = from.PostInstall
+	p.Launch = from.Launch
+	p.Logcat = from.Logcat
+	p.Emulator = from.Emulator
+}
+
+// runProfile is the active profile with the device flags of the command line
+// applied. It is used by this run only and never saved, the GUI leaves it nil.
+var runProfile *Profile
+
+// runningProfile returns the profile the device stages of the run use.
+func runningProfile() *Profile {
+	if runProfile != nil {
+		return runProfile
+	}
+	return config.profile()
+}
+
+// splitDomains splits the comma separated domains of the domain field.
+func splitDomains(domains string) []string {
+	result := []string{}
+	for _, domain := range strings.Split(domains, ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			result = append(result, domain)
+		}
+	}
+	return uniqueStrings(result)
+}
+
+// marshalProfile returns the named profile in the export format.
+func marshalProfile(name string) ([]byte, error) {
+	p, ok := config.Profiles[name]
+	if !ok {
+		return nil, errors.New(T("unknownProfile", Args{"name": name}))
+	}
+	return yaml.Marshal(profileFile{Name: name, Profile: *p})
+}
+
+// exportProfile writes the named profile to path so it can be shared.
+func exportProfile(name, path string) error {
+	content, err := marshalProfile(name)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, content, 0644)
+}
+
+// importProfile adds the profile exported to path to the config and saves it.
+// The profile is named after the file when name is empty and the file does
+// not carry a name, an existing profile of the same name is replaced.
+func importProfile(path, name string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	var imported profileFile
+	if err := yaml.Unmarshal(content, &imported); err != nil {
+		return "", err
+	}
+	if name == "" {
+		name = imported.Name
+	}
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	config.profile()
+	config.Profiles[name] = &imported.Profile
+	return name, saveConfig()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfigMigratesAndKeepsBackup(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		content    string
+		wantBackup string
+	}{
+		{
+			name:       "v0 without version",
+			content:    "language: zh\nprofile:\n  keystore: old.jks\n",
+			wantBackup: "apicker.yml.v1.bak",
+		},
+		{
+			name:       "v1",
+			content:    "version: 1\nlanguage: zh\nprofile:\n  keystore: old.jks\n",
+			wantBackup: "apicker.yml.v1.bak",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			home := useTestConfig(t)
+			path := filepath.Join(home, ".config", "apicker.yml")
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(path, []byte(test.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := loadConfig(); err != nil {
+				t.Fatal(err)
+			}
+			if p := config.Profiles[defaultProfileName]; p == nil || p.Keystore != "old.jks" {
+				t.Errorf("default profile = %+v, want the old profile", p)
+			}
+			if config.LegacyProfile != nil || config.Language != "zh" {
+				t.Errorf("config = %+v, want the migrated config", config)
+			}
+
+			backup, err := ioutil.ReadFile(filepath.Join(home, ".config", test.wantBackup))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(backup) != test.content {
+				t.Errorf("backup = %q, want %q", backup, test.content)
+			}
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			saved, version, err := decodeConfig(content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version != configVersion || saved.Profiles[defaultProfileName].Keystore != "old.jks" {
+				t.Errorf("saved config version %d = %+v, want the migrated config", version, saved)
+			}
+		})
+	}
+}
+
+func TestLoadConfigRefusesNewerVersion(t *testing.T) {
+	home := useTestConfig(t)
+	path := filepath.Join(home, ".config", "apicker.yml")
+	content := "version: 99\n"
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfig(); err == nil {
+		t.Fatal("loadConfig() succeeded, want an error")
+	}
+	if !configReadOnly {
+		t.Error("config is not read-only after the error")
+	}
+	if err := saveConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if saved, _ := ioutil.ReadFile(path); string(saved) != content {
+		t.Errorf("config file = %q, want it untouched", saved)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// configVersion is the format of the config file written by this version.
+//
+//	1: language and a single profile, files without a version
+//	2: named profiles
+const configVersion = 2
+
+// configMigrations upgrade a config from the version they are keyed by to the
+// next one.
+var configMigrations = map[int]func(c *Config) error{
+	1: migrateConfigV1,
+}
+
+func migrateConfig(c *Config) error {
+	for c.Version < configVersion {
+		migrate, ok := configMigrations[c.Version]
+		if !ok {
+			return fmt.Errorf("no migration from config version %d", c.Version)
+		}
+		if err := migrate(c); err != nil {
+			return fmt.Errorf("migrating config version %d: %v", c.Version, err)
+		}
+		c.Version++
+	}
+	return nil
+}
+
+// migrateConfigV1 moves the single profile to the default named profile.
+func migrateConfigV1(c *Config) error {
+	if c.LegacyProfile == nil {
+		return nil
+	}
+	if c.Profiles == nil {
+		c.Profiles = make(map[string]*Profile)
+	}
+	if _, ok := c.Profiles[defaultProfileName]; !ok {
+		c.Profiles[defaultProfileName] = c.LegacyProfile
+	}
+	c.LegacyProfile = nil
+	return nil
+}
+
+// backupConfig keeps the content of the config file before a migration, an
+// existing backup of the same version is not overwritten.
+func backupConfig(path string, content []byte, version int) (string, error) {
+	backup := fmt.Sprintf("%s.v%d.bak", path, version)
+	if _, err := os.Stat(backup); err == nil {
+		return backup, nil
+	}
+	return backup, ioutil.WriteFile(backup, content, 0600)
+}
+
+var (
+	languagePattern = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+	domainPattern   = regexp.MustCompile(`^([A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?\.)*[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?$`)
+	appOpsModes     = []string{"allow", "ignore", "deny", "default", "foreground"}
+)
+
+// validate checks the values of the config, all problems are reported with
+// the path of the value.
+func (c *Config) validate() error {
+	problems := []string{}
+	invalid := func(path string, value interface{}, expected string) {
+		problems = append(problems, fmt.Sprintf("%s: invalid value %q, %s", path, fmt.Sprint(value), expected))
+	}
+
+	if c.Language != "" && !languagePattern.MatchString(c.Language) {
+		invalid("language", c.Language, "expected a language tag like en or zh-TW")
+	}
+	if c.Font != "" && filepath.Ext(c.Font) != "" && !isLoadableFont(c.Font) {
+		invalid("font", c.Font, "expected a .ttf or .otf font, font collections are not supported")
+	}
+	if c.ActiveProfile != "" && len(c.Profiles) > 0 {
+		if _, ok := c.Profiles[c.ActiveProfile]; !ok {
+			invalid("activeProfile", c.ActiveProfile, "no profile has this name")
+		}
+	}
+	names := make([]string, 0, len(c.Profiles))
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p := c.Profiles[name]
+		path := "profiles." + name
+		if strings.TrimSpace(name) == "" {
+			invalid("profiles", name, "profile names can not be empty")
+		}
+		if p == nil {
+			continue
+		}
+		for i, domain := range p.Domains {
+			if !domainPattern.MatchString(domain) {
+				invalid(fmt.Sprintf("%s.domains[%d]", path, i), domain, "expected a host name like api.example.com")
+			}
+		}
+		for i, caFile := range p.CAFiles {
+			if strings.TrimSpace(caFile) == "" {
+				invalid(fmt.Sprintf("%s.caFiles[%d]", path, i), caFile, "expected a file path")
+			}
+		}
+		for i, permission := range p.PostInstall.GrantPermissions {
+			if strings.TrimSpace(permission) == "" {
+				invalid(fmt.Sprintf("%s.postInstall.grantPermissions[%d]", path, i), permission, "expected a permission name")
+			}
+		}
+		for op, mode := range p.PostInstall.AppOps {
+			if !containsString(appOpsModes, mode) {
+				invalid(path+".postInstall.appOps."+op, mode, "expected one of "+strings.Join(appOpsModes, ", "))
+			}
+		}
+		if _, err := parseLogcatLevel(p.Logcat.Level); err != nil {
+			invalid(path+".logcat.level", p.Logcat.Level, "expected one of V, D, I, W, E, F, S or their names")
+		}
+		if p.Launch.WaitSeconds < 0 {
+			invalid(path+".launch.waitSeconds", p.Launch.WaitSeconds, "expected a number of seconds")
+		}
+		if p.Emulator.BootTimeout < 0 {
+			invalid(path+".emulator.bootTimeout", p.Emulator.BootTimeout, "expected a number of seconds")
+		}
+	}
+	for i, r := range c.Recent {
+		if r.Path == "" {
+			invalid(fmt.Sprintf("recent[%d].path", i), r.Path, "expected a file path")
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New("invalid config:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
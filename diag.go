@@ -0,0 +1,238 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxDiagLogLines is how much of the log is bundled for reports without a
+// run ID.
+const maxDiagLogLines = 2000
+
+var (
+	passFlagPattern  = regexp.MustCompile(`(?i)(-(?:(?:src|dest)?(?:store|key)pass|-?(?:keystore|key)Password))(\s+|=|",\s*")[^\s"\],]+`)
+	passValuePattern = regexp.MustCompile(`\bpass:[^\s"\],]+`)
+)
+
+// redactLogLine removes passwords from a log line and replaces the home
+// directory, which usually contains the user name, with ~.
+func redactLogLine(line string) string {
+	line = passFlagPattern.ReplaceAllString(line, "${1}${2}***")
+	line = passValuePattern.ReplaceAllString(line, "pass:***")
+	if homeDir, err := os.UserHomeDir(); err == nil && len(homeDir) > 1 {
+		line = strings.ReplaceAll(line, homeDir, "~")
+	}
+	return line
+}
+
+// findReport returns the report of a run, given by the path of its report
+// or by its run ID. Without either the newest report in the working
+// directory or in the directories of a batch is used.
+func findReport(arg string) (string, error) {
+	if arg != "" {
+		if _, err := os.Stat(arg); err == nil {
+			return arg, nil
+		}
+	}
+	paths, err := filepath.Glob("*_report.json")
+	if err != nil {
+		return "", err
+	}
+	batchPaths, _ := filepath.Glob(filepath.Join(batchDir, "*", "*_report.json"))
+	paths = append(paths, batchPaths...)
+	// 最新的报告排在前面
+	sort.Slice(paths, func(i, j int) bool {
+		a, _ := os.Stat(paths[i])
+		b, _ := os.Stat(paths[j])
+		return a.ModTime().After(b.ModTime())
+	})
+	for _, path := range paths {
+		if arg == "" {
+			return path, nil
+		}
+		if report, err := readReport(path); err == nil && report.RunID == arg {
+			return path, nil
+		}
+	}
+	if arg != "" {
+		return "", errors.New(T("noRunReport", Args{"run": arg}))
+	}
+	return "", errors.New(T("noReport"))
+}
+
+func readReport(path string) (*runReport, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	report := &runReport{}
+	if err := json.Unmarshal(content, report); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	report.ReportPath = path
+	return report, nil
+}
+
+// defaultDiagPath is the name of a bundle in the working directory.
+func defaultDiagPath(report *runReport) string {
+	name := report.RunID
+	if name == "" {
+		name = report.Package
+	}
+	return fmt.Sprintf("apicker-diag-%s-%s.zip", name, time.Now().Format("20060102-150405"))
+}
+
+// writeDiagnostics zips what is needed to look into a run: its report, the
+// redacted log records, the tool versions, OS information and the patched
+// manifest and network security config.
+func writeDiagnostics(ctx context.Context, reportPath, zipPath string) error {
+	report, err := readReport(reportPath)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(zipPath)
+	if err != nil {
+		return err
+	}
+	zw := zip.NewWriter(f)
+	err = writeDiagnosticsTo(ctx, zw, report)
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(zipPath)
+	}
+	return err
+}
+
+func writeDiagnosticsTo(ctx context.Context, zw *zip.Writer, report *runReport) error {
+	content, err := ioutil.ReadFile(report.ReportPath)
+	if err != nil {
+		return err
+	}
+	if err := writeZipFile(zw, "report.json", []byte(redactLogLine(string(content)))); err != nil {
+		return err
+	}
+	if err := writeZipFile(zw, "apicker.log", []byte(diagLog(report.RunID))); err != nil {
+		return err
+	}
+	if err := writeZipFile(zw, "versions.txt", []byte(toolVersions(ctx))); err != nil {
+		return err
+	}
+	if err := writeZipFile(zw, "system.txt", []byte(systemInfo())); err != nil {
+		return err
+	}
+	// 修改后的清单和网络安全配置，读取运行结束时保存在报告旁边的副本
+	files := make([]string, 0, len(report.WorkFiles))
+	for file := range report.WorkFiles {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		content, err := ioutil.ReadFile(filepath.Join(filepath.Dir(report.ReportPath), report.WorkFiles[file]))
+		if err != nil {
+			continue
+		}
+		if err := writeZipFile(zw, file, content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeZipFile(zw *zip.Writer, name string, content []byte) error {
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(content)
+	return err
+}
+
+// diagLog returns the redacted records of the run from the log file and the
+// rotated ones, oldest first. Without a run ID the end of the log is used.
+func diagLog(runID string) string {
+	paths := []string{}
+	for i := maxLogFiles; i >= 1; i-- {
+		paths = append(paths, fmt.Sprintf("%s.%d", logFilePath(), i))
+	}
+	paths = append(paths, logFilePath())
+
+	lines := []string{}
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if runID != "" && !strings.Contains(line, "run="+runID) && !strings.Contains(line, `"run":"`+runID+`"`) {
+				continue
+			}
+			lines = append(lines, redactLogLine(line))
+			if runID == "" && len(lines) > maxDiagLogLines {
+				lines = lines[1:]
+			}
+		}
+		f.Close()
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// toolVersions runs the version command of each tool, missing tools are
+// listed as such.
+func toolVersions(ctx context.Context) string {
+	var b strings.Builder
+	for _, spec := range toolSpecs {
+		if len(spec.VersionArgs) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "$ %s %s\n", redactLogLine(toolPath(spec.Name)), strings.Join(spec.VersionArgs, " "))
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		output, err := toolCommandContext(ctx, spec.Name, spec.VersionArgs...).CombinedOutput()
+		cancel()
+		b.Write(output)
+		if err != nil {
+			fmt.Fprintf(&b, "error: %v\n", err)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func systemInfo() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "os: %s\narch: %s\ngo: %s\n", runtime.GOOS, runtime.GOARCH, runtime.Version())
+	if runtime.GOOS != "windows" {
+		if output, err := exec.Command("uname", "-a").Output(); err == nil {
+			fmt.Fprintf(&b, "uname: %s", output)
+		}
+	}
+	fmt.Fprintf(&b, "language: %s\n", currentLang)
+	for _, name := range []string{"LANG", "LC_ALL", "JAVA_HOME", "ANDROID_HOME", "ANDROID_SDK_ROOT"} {
+		if value := os.Getenv(name); value != "" {
+			fmt.Fprintf(&b, "%s: %s\n", name, redactLogLine(value))
+		}
+	}
+	fmt.Fprintf(&b, "log: %s\n", redactLogLine(logFilePath()))
+	fmt.Fprintf(&b, "tool cache: %s\n", redactLogLine(toolCacheDir()))
+	return b.String()
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRedactLogLine(t *testing.T) {
+	t.Setenv("HOME", "/home/alice")
+	if home, _ := os.UserHomeDir(); home != "/home/alice" {
+		t.Skip("home directory is not taken from HOME")
+	}
+	for _, test := range []struct {
+		line string
+		want string
+	}{
+		{"keytool -list -keystore k.jks -storepass secret", "keytool -list -keystore k.jks -storepass ***"},
+		{"jarsigner -storepass s3cr3t -keypass other k.apk", "jarsigner -storepass *** -keypass *** k.apk"},
+		{"keytool -importkeystore -srcstorepass a -deststorepass b", "keytool -importkeystore -srcstorepass *** -deststorepass ***"},
+		{`args="[keytool -storepass", "secret", "-alias", "x]"`, `args="[keytool -storepass", "***", "-alias", "x]"`},
+		{"apksigner sign --ks-pass pass:secret --key-pass pass:other", "apksigner sign --ks-pass pass:*** --key-pass pass:***"},
+		{`args="[apksigner --ks-pass "pass:secret"]"`, `args="[apksigner --ks-pass "pass:***"]"`},
+		{"keytool -storepass:env APICKER_SIGN_STOREPASS", "keytool -storepass:env APICKER_SIGN_STOREPASS"},
+		{"apksigner --ks-pass env:APICKER_SIGN_STOREPASS", "apksigner --ks-pass env:APICKER_SIGN_STOREPASS"},
+		{"apicker patch -keystorePassword hunter2 app.apk", "apicker patch -keystorePassword *** app.apk"},
+		{"apicker patch --keyPassword=s3cret app.apk", "apicker patch --keyPassword=*** app.apk"},
+		{"apicker patch -KEYSTOREPASSWORD=hunter2 -keypassword hunter2", "apicker patch -KEYSTOREPASSWORD=*** -keypassword ***"},
+		{`args="[patch -keystorePassword hunter2]"`, `args="[patch -keystorePassword ***]"`},
+		{`"args":["patch","--keyPassword","s3cret"]`, `"args":["patch","--keyPassword","***"]`},
+		{"input=/home/alice/apps/app.apk", "input=~/apps/app.apk"},
+		{"compass: north", "compass: north"},
+	} {
+		if got := redactLogLine(test.line); got != test.want {
+			t.Errorf("redactLogLine(%q) = %q, want %q", test.line, got, test.want)
+		}
+	}
+}
+
+func TestDiagnosticsKeepManifestOfTheRun(t *testing.T) {
+	useTestConfig(t)
+	dir := t.TempDir()
+	workDir := filepath.Join(dir, "output")
+	writeRun := func(manifest string, withNSC bool) *runReport {
+		os.RemoveAll(workDir)
+		files := map[string]string{"AndroidManifest.xml": manifest}
+		if withNSC {
+			files["res/xml/network_security_config.xml"] = "<network-security-config/>"
+		}
+		for name, content := range files {
+			path := filepath.Join(workDir, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		report := &runReport{RunID: manifest, Input: "app.apk", Package: manifest, WorkDir: workDir, dir: dir}
+		if err := report.save(); err != nil {
+			t.Fatal(err)
+		}
+		return report
+	}
+	first := writeRun("first", true)
+	// the second run replaces the work directory, a batch then removes it
+	writeRun("second", false)
+	os.RemoveAll(workDir)
+
+	zipPath := filepath.Join(dir, "diag.zip")
+	if err := writeDiagnostics(context.Background(), first.ReportPath, zipPath); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.OpenReader(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	got := map[string]string{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		got[f.Name] = string(content)
+	}
+	if got["AndroidManifest.xml"] != "first" {
+		t.Errorf("manifest = %q, want the one of the first run", got["AndroidManifest.xml"])
+	}
+	if got["res/xml/network_security_config.xml"] != "<network-security-config/>" {
+		t.Errorf("network security config = %q, want the one of the first run", got["res/xml/network_security_config.xml"])
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+// showDoctorDialog 显示各个工具的检查结果，有问题的工具下面写明怎么修复。
+// 可以下载的工具有问题时提供下载按钮，download 收到要下载的固定版本
+func showDoctorDialog(window fyne.Window, checks []toolCheck, download func(pins []string)) {
+	texts := &textScope{}
+	grid := container.NewGridWithColumns(5,
+		texts.label("toolName"), texts.label("toolNeeded"), texts.label("toolStatus"), texts.label("toolVersion"), texts.label("toolPath"))
+	for _, label := range grid.Objects {
+		label.(*widget.Label).TextStyle = fyne.TextStyle{Bold: true}
+	}
+	fixes := container.NewVBox()
+	fetchable := []string{}
+	for _, check := range checks {
+		needed := widget.NewLabel("")
+		if check.Required {
+			texts.keyed(needed.SetText).SetKey("toolRequired")
+		} else {
+			texts.keyed(needed.SetText).SetKey("toolOptional")
+		}
+		status := widget.NewLabel("")
+		texts.keyed(status.SetText).SetKey("toolStatus_"+check.Status, Args{"min": check.MinVersion})
+		path := widget.NewLabel(check.Path)
+		path.Truncation = fyne.TextTruncateEllipsis
+		grid.Add(widget.NewLabel(check.Name))
+		grid.Add(needed)
+		grid.Add(status)
+		grid.Add(widget.NewLabel(check.Version))
+		grid.Add(path)
+
+		if !check.needsFix() {
+			continue
+		}
+		title := widget.NewLabel(check.Name)
+		title.TextStyle = fyne.TextStyle{Bold: true}
+		fix := widget.NewLabel("")
+		fix.Wrapping = fyne.TextWrapWord
+		texts.keyed(fix.SetText).SetKey("toolFix_" + check.Name)
+		fixes.Add(title)
+		if check.Error != "" {
+			errorLabel := widget.NewLabel(check.Error)
+			errorLabel.Wrapping = fyne.TextWrapWord
+			fixes.Add(errorLabel)
+		}
+		fixes.Add(fix)
+		if isFetchable(check.Name) {
+			fetchable = append(fetchable, check.Name)
+			fixes.Add(texts.label("toolFetchHint"))
+		}
+	}
+	content := container.NewVScroll(container.NewVBox(grid, widget.NewSeparator(), fixes))
+	if len(fetchable) == 0 {
+		showTranslatedDialog(texts, func(func(bool)) dialog.Dialog {
+			d := dialog.NewCustom(T("toolsTitle"), T("close"), content, window)
+			d.Resize(fyne.NewSize(800, 500))
+			return d
+		}, nil)
+		return
+	}
+	showTranslatedDialog(texts, func(callback func(bool)) dialog.Dialog {
+		d := dialog.NewCustomConfirm(T("toolsTitle"), T("downloadTools"), T("close"), content, callback, window)
+		d.Resize(fyne.NewSize(800, 500))
+		return d
+	}, func(ok bool) {
+		if ok {
+			download(pinsProviding(fetchable))
+		}
+	})
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EmulatorOptions selects an AVD to run the patched app on.
+type EmulatorOptions struct {
+	AVD         string `yaml:"avd,omitempty"`
+	ShowWindow  bool   `yaml:"showWindow,omitempty"`
+	Root        bool   `yaml:"root,omitempty"`
+	SystemCA    string `yaml:"systemCA,omitempty"`
+	BootTimeout int    `yaml:"bootTimeout,omitempty"`
+	KeepRunning bool   `yaml:"keepRunning,omitempty"`
+}
+
+const defaultBootTimeoutSeconds = 300
+
+const (
+	systemCACertsDir = "/system/etc/security/cacerts"
+	// conscryptCACertsDir is where Android 14 and later read the system CAs
+	// from, the APEX is mounted into the namespace of zygote and of every app
+	conscryptCACertsDir = "/apex/com.android.conscrypt/cacerts"
+	conscryptCAMinAPI   = 34
+)
+
+// zygoteNamespace runs the rest of a shell command in the mount namespace of
+// zygote, which the apps are forked from.
+const zygoteNamespace = "set -- $(pidof zygote64 zygote); nsenter --mount=/proc/$1/ns/mnt --"
+
+var (
+	startedEmulators   []string
+	startedEmulatorsMu sync.Mutex
+	// prepareEmulatorMu keeps parallel runs from booting the same AVD twice
+	prepareEmulatorMu sync.Mutex
+)
+
+// listAVDs returns the names of the available Android virtual devices.
+func listAVDs() ([]string, error) {
+	output, err := toolCommand("emulator", "-list-avds").Output()
+	if err != nil {
+		return nil, err
+	}
+	avds := []string{}
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		// newer emulators print warnings like "INFO | ..." before the list
+		if line != "" && !strings.Contains(line, "|") {
+			avds = append(avds, line)
+		}
+	}
+	return avds, nil
+}
+
+func listDeviceSerials() ([]string, error) {
+	output, err := toolCommand("adb", "devices").Output()
+	if err != nil {
+		return nil, err
+	}
+	serials := []string{}
+	for _, line := range strings.Split(string(output), "\n") {
+		parts := strings.Fields(line)
+		if len(parts) == 2 && parts[0] != "List" {
+			serials = append(serials, parts[0])
+		}
+	}
+	return serials, nil
+}
+
+// findRunningEmulator returns the serial of a running emulator for the AVD.
+func findRunningEmulator(avd string) string {
+	serials, err := listDeviceSerials()
+	if err != nil {
+		return ""
+	}
+	for _, serial := range serials {
+		if !strings.HasPrefix(serial, "emulator-") {
+			continue
+		}
+		output, err := toolCommand("adb", "-s", serial, "emu", "avd", "name").Output()
+		if err != nil {
+			continue
+		}
+		if name := strings.TrimSpace(strings.Split(string(output), "\n")[0]); name == avd {
+			return serial
+		}
+	}
+	return ""
+}
+
+func freeEmulatorPort() int {
+	serials, _ := listDeviceSerials()
+	used := make(map[string]bool)
+	for _, serial := range serials {
+		used[serial] = true
+	}
+	for port := 5554; port < 5682; port += 2 {
+		if !used[fmt.Sprintf("emulator-%d", port)] {
+			return port
+		}
+	}
+	return 5554
+}
+
+// bootEmulator starts the AVD and waits until Android has finished booting.
+func bootEmulator(ctx context.Context, opts EmulatorOptions) (string, error) {
+	port := freeEmulatorPort()
+	serial := fmt.Sprintf("emulator-%d", port)
+	args := []string{"-avd", opts.AVD, "-port", fmt.Sprint(port), "-no-audio", "-no-boot-anim", "-no-snapshot-save"}
+	if !opts.ShowWindow {
+		args = append(args, "-no-window")
+	}
+	cmd := toolCommand("emulator", args...)
+	slog.Info("Running command", "args", redactArgs(cmd.Args))
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	timeout := opts.BootTimeout
+	if timeout <= 0 {
+		timeout = defaultBootTimeoutSeconds
+	}
+	deadline := time.Now().Add(time.Duration(timeout) * time.Second)
+	for {
+		select {
+		case err := <-exited:
+			return "", fmt.Errorf("emulator exited during boot: %v", err)
+		case <-ctx.Done():
+			shutdownEmulator(serial)
+			return "", ctx.Err()
+		case <-time.After(2 * time.Second):
+		}
+		output, err := toolCommand("adb", "-s", serial, "shell", "getprop", "sys.boot_completed").Output()
+		if err == nil && strings.TrimSpace(string(output)) == "1" {
+			return serial, nil
+		}
+		if time.Now().After(deadline) {
+			shutdownEmulator(serial)
+			return "", fmt.Errorf("emulator %s did not boot within %d seconds", opts.AVD, timeout)
+		}
+	}
+}
+
+func shutdownEmulator(serial string) error {
+	slog.Info("Shutting down emulator", "serial", serial)
+	return toolCommand("adb", "-s", serial, "emu", "kill").Run()
+}
+
+// shutdownStartedEmulators stops the emulators that were booted by this process.
+func shutdownStartedEmulators() {
+	startedEmulatorsMu.Lock()
+	serials := startedEmulators
+	startedEmulators = nil
+	startedEmulatorsMu.Unlock()
+	for _, serial := range serials {
+		if err := shutdownEmulator(serial); err != nil {
+			slog.Warn("Error shutting down emulator", "serial", serial, "error", err)
+		}
+	}
+}
+
+func rootEmulator(serial string) error {
+	if output, err := toolCommand("adb", "-s", serial, "root").CombinedOutput(); err != nil {
+		return fmt.Errorf("root error: %v, %s", err, strings.TrimSpace(string(output)))
+	}
+	return toolCommand("adb", "-s", serial, "wait-for-device").Run()
+}
+
+// subjectHashOld computes the file name Android uses for a CA in the system store.
+func subjectHashOld(cert *x509.Certificate) string {
+	sum := md5.Sum(cert.RawSubject)
+	return fmt.Sprintf("%08x", binary.LittleEndian.Uint32(sum[:4]))
+}
+
+func readCertificate(path string) (*x509.Certificate, []byte, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	der := content
+	if block, _ := pem.Decode(content); block != nil {
+		der = block.Bytes
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+// deviceAPILevel returns the SDK version of the device.
+func deviceAPILevel(serial string) (int, error) {
+	output, err := toolCommand("adb", "-s", serial, "shell", "getprop", "ro.build.version.sdk").Output()
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(output)))
+}
+
+// systemCAInstalled tells whether the apps see the certificate, from Android
+// 14 on in the conscrypt APEX of the zygote namespace.
+func systemCAInstalled(serial, name string, apiLevel int) bool {
+	if apiLevel >= conscryptCAMinAPI {
+		return adbShell(serial, "sh", "-c", "'"+zygoteNamespace+" ls "+conscryptCACertsDir+"/"+name+"'") == nil
+	}
+	return adbShell(serial, "ls", systemCACertsDir+"/"+name) == nil
+}
+
+// installSystemCA adds the certificate to the system trust store of a rooted
+// emulator. The store is overlaid with a tmpfs, so the change is gone after
+// reboot. From Android 14 on the store of the conscrypt APEX is used, the
+// overlay is bind mounted over it in zygote and in the running apps.
+func installSystemCA(serial, certPath string) error {
+	cert, pemContent, err := readCertificate(certPath)
+	if err != nil {
+		return fmt.Errorf("reading CA certificate: %v", err)
+	}
+	apiLevel, err := deviceAPILevel(serial)
+	if err != nil {
+		return fmt.Errorf("reading API level: %v", err)
+	}
+	name := subjectHashOld(cert) + ".0"
+	if systemCAInstalled(serial, name, apiLevel) {
+		slog.Info("System CA already installed", "name", name)
+		return nil
+	}
+	sourceDir := systemCACertsDir
+	if apiLevel >= conscryptCAMinAPI {
+		sourceDir = conscryptCACertsDir
+	}
+	tmpFile, err := ioutil.TempFile("", name)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Write(pemContent)
+	tmpFile.Close()
+
+	remote := "/data/local/tmp/" + name
+	if output, err := toolCommand("adb", "-s", serial, "push", tmpFile.Name(), remote).CombinedOutput(); err != nil {
+		return fmt.Errorf("push error: %v, %s", err, strings.TrimSpace(string(output)))
+	}
+	commands := []string{
+		"set -e",
+		"rm -rf /data/local/tmp/apicker-cacerts",
+		"mkdir -p /data/local/tmp/apicker-cacerts",
+		"cp " + sourceDir + "/* /data/local/tmp/apicker-cacerts/",
+		"mount -t tmpfs tmpfs " + systemCACertsDir,
+		"cp /data/local/tmp/apicker-cacerts/* " + systemCACertsDir + "/",
+		"cp " + remote + " " + systemCACertsDir + "/" + name,
+		"chown root:root " + systemCACertsDir + "/*",
+		"chmod 644 " + systemCACertsDir + "/*",
+		"chcon u:object_r:system_file:s0 " + systemCACertsDir + "/*",
+	}
+	if apiLevel >= conscryptCAMinAPI {
+		// 新启动的应用从 zygote 继承挂载，已经在运行的应用逐个处理，退出了的进程忽略
+		bind := "/system/bin/mount --bind " + systemCACertsDir + " " + conscryptCACertsDir
+		commands = append(commands,
+			bind,
+			"for z in $(pidof zygote zygote64); do nsenter --mount=/proc/$z/ns/mnt -- "+bind+"; done",
+			"for p in $(for z in $(pidof zygote zygote64); do ps -o PID -P $z | grep -v PID; done); do nsenter --mount=/proc/$p/ns/mnt -- "+bind+" || true; done",
+		)
+	}
+	if err := adbShell(serial, "sh", "-c", "'"+strings.Join(commands, "; ")+"'"); err != nil {
+		return fmt.Errorf("installing system CA: %v", err)
+	}
+	if !systemCAInstalled(serial, name, apiLevel) {
+		return fmt.Errorf("installing system CA: %s is not visible to apps on API level %d", name, apiLevel)
+	}
+	slog.Info("System CA installed", "name", name, "apiLevel", apiLevel)
+	return nil
+}
+
+// prepareEmulator makes sure the configured AVD is running and set up, and
+// returns its serial.
+func prepareEmulator(ctx context.Context, opts EmulatorOptions) (string, error) {
+	prepareEmulatorMu.Lock()
+	defer prepareEmulatorMu.Unlock()
+	serial := findRunningEmulator(opts.AVD)
+	if serial == "" {
+		slog.Info("Booting emulator", "avd", opts.AVD)
+		var err error
+		serial, err = bootEmulator(ctx, opts)
+		if err != nil {
+			return "", err
+		}
+		startedEmulatorsMu.Lock()
+		startedEmulators = append(startedEmulators, serial)
+		startedEmulatorsMu.Unlock()
+	}
+	if opts.Root || opts.SystemCA != "" {
+		if err := rootEmulator(serial); err != nil {
+			return serial, err
+		}
+	}
+	if opts.SystemCA != "" {
+		if err := installSystemCA(serial, opts.SystemCA); err != nil {
+			return serial, err
+		}
+	}
+	return serial, nil
+}
+
+// getTargetDevice returns the device to install on, booting the configured
+// emulator when there is one.
+func getTargetDevice(ctx context.Context) (string, error) {
+	if runningProfile().Emulator.AVD != "" {
+		return prepareEmulator(ctx, runningProfile().Emulator)
+	}
+	return getConnectedDevice()
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"github.com/flopp/go-findfont"
+)
+
+// cjkFonts are looked for in this order when no font is configured, the
+// Fyne default font has no CJK glyphs. Fyne can not load font collections
+// (.ttc), so only single fonts are listed.
+var cjkFonts = []string{
+	"NotoSansCJKsc-Regular.otf",
+	"NotoSansSC-Regular.otf",
+	"NotoSansSC-Regular.ttf",
+	"NotoSansCJKtc-Regular.otf",
+	"NotoSansCJKjp-Regular.otf",
+	"NotoSansCJKkr-Regular.otf",
+	"SourceHanSansSC-Regular.otf",
+	"SourceHanSansCN-Regular.otf",
+	"DroidSansFallbackFull.ttf",
+	"DroidSansFallback.ttf",
+	"Deng.ttf",
+	"simhei.ttf",
+	"malgun.ttf",
+	"Arial Unicode.ttf",
+}
+
+// isLoadableFont tells whether Fyne can load the font file.
+func isLoadableFont(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".ttf" || ext == ".otf"
+}
+
+// resolveFont returns the configured font, or else the first CJK font found
+// on the system. nil means the Fyne default font, which also honours
+// FYNE_FONT.
+func resolveFont(configured string) fyne.Resource {
+	if configured != "" {
+		font, err := loadFont(configured)
+		if err == nil {
+			return font
+		}
+		slog.Warn("Error loading the configured font, looking for a CJK font", "font", configured, "error", err)
+	} else if os.Getenv("FYNE_FONT") != "" {
+		return nil
+	}
+	path := findCJKFont(findfont.List())
+	if path == "" {
+		slog.Info("No CJK font found, using the default font")
+		return nil
+	}
+	font, err := fyne.LoadResourceFromPath(path)
+	if err != nil {
+		slog.Warn("Error loading font, using the default font", "font", path, "error", err)
+		return nil
+	}
+	slog.Info("Using font", "font", path)
+	return font
+}
+
+// loadFont loads a font given by its path or by its file name in the user
+// and system font directories.
+func loadFont(name string) (fyne.Resource, error) {
+	path, err := findfont.Find(name)
+	if err != nil {
+		return nil, err
+	}
+	if !isLoadableFont(path) {
+		return nil, fmt.Errorf("%s: only .ttf and .otf fonts are supported", path)
+	}
+	return fyne.LoadResourceFromPath(path)
+}
+
+// findCJKFont returns the path of the first of cjkFonts in paths.
+func findCJKFont(paths []string) string {
+	byName := make(map[string]string, len(paths))
+	for _, path := range paths {
+		name := strings.ToLower(filepath.Base(path))
+		if _, ok := byName[name]; !ok {
+			byName[name] = path
+		}
+	}
+	for _, name := range cjkFonts {
+		if path, ok := byName[strings.ToLower(name)]; ok {
+			return path
+		}
+	}
+	return ""
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// APKs pulled from a device are stored below this directory, one folder per package.
+const pulledDir = "pulled"
+
+// listThirdPartyPackages returns the packages installed by the user on the device.
+func listThirdPartyPackages(device string) ([]string, error) {
+	output, err := toolCommand("adb", "-s", device, "shell", "pm", "list", "packages", "-3").Output()
+	if err != nil {
+		return nil, err
+	}
+	packages := []string{}
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "package:") {
+			packages = append(packages, strings.TrimPrefix(line, "package:"))
+		}
+	}
+	sort.Strings(packages)
+	return packages, nil
+}
+
+// getPackagePaths returns the on-device paths of the base and split APKs, the
+// base APK always comes first.
+func getPackagePaths(device, packageName string) ([]string, error) {
+	output, err := toolCommand("adb", "-s", device, "shell", "pm", "path", packageName).Output()
+	if err != nil {
+		return nil, err
+	}
+	base := ""
+	splits := []string{}
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "package:") {
+			continue
+		}
+		path := strings.TrimPrefix(line, "package:")
+		if filepath.Base(path) == "base.apk" {
+			base = path
+		} else {
+			splits = append(splits, path)
+		}
+	}
+	if base == "" {
+		if len(splits) == 0 {
+			return nil, fmt.Errorf("package %s is not installed", packageName)
+		}
+		base, splits = splits[0], splits[1:]
+	}
+	return append([]string{base}, splits...), nil
+}
+
+// pullPackage copies the APKs of an installed package into destDir and returns
+// the local paths, base APK first.
+func pullPackage(device, packageName, destDir string) ([]string, error) {
+	remotePaths, err := getPackagePaths(device, packageName)
+	if err != nil {
+		return nil, err
+	}
+	os.RemoveAll(destDir)
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return nil, err
+	}
+	localPaths := []string{}
+	for _, remotePath := range remotePaths {
+		localPath := filepath.Join(destDir, filepath.Base(remotePath))
+		slog.Info("Pulling", "path", remotePath)
+		if output, err := toolCommand("adb", "-s", device, "pull", remotePath, localPath).CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("pull error: %v, %s", err, strings.TrimSpace(string(output)))
+		}
+		localPaths = append(localPaths, localPath)
+	}
+	return localPaths, nil
+}
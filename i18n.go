@@ -0,0 +1,362 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/text/language"
+	"gopkg.in/yaml.v3"
+)
+
+// the translations are compiled into the binary, one <lang>.yaml per language
+//
+//go:embed i18n/*.yaml
+var translationFiles embed.FS
+
+// fallbackLanguage is used for keys missing in the current language, its file
+// is the reference the other languages are checked against.
+const fallbackLanguage = "en"
+
+// translationPack is a <locale>.yaml file of the user, it adds a language or
+// overrides keys of a built-in one.
+type translationPack struct {
+	Language string
+	Path     string
+	// Warnings are the problems found comparing the pack with en.yaml
+	Warnings []string
+}
+
+var (
+	// translationPacks are the packs loaded with the translations
+	translationPacks []translationPack
+	translationsMu   sync.RWMutex
+)
+
+// translationPacksDir is where translation packs are looked up.
+func translationPacksDir() string {
+	homeDir, _ := os.UserHomeDir()
+	return filepath.Join(homeDir, ".config", "apicker", "i18n")
+}
+
+// reloadTranslations loads the built-in translations and the packs of the
+// user and makes them current.
+func reloadTranslations() error {
+	loaded, err := loadLanguageFiles()
+	packs, packErr := loadTranslationPacks(translationPacksDir(), loaded)
+	for _, pack := range packs {
+		for _, warning := range pack.Warnings {
+			slog.Warn("Translation pack", "path", pack.Path, "warning", warning)
+		}
+	}
+	translationsMu.Lock()
+	translations, translationPacks = loaded, packs
+	translationsMu.Unlock()
+	if err == nil {
+		err = packErr
+	}
+	return err
+}
+
+// loadLanguageFiles reads the embedded translations. A broken file is
+// reported and skipped, the other languages are still loaded.
+func loadLanguageFiles() (map[string]map[string]message, error) {
+	translations := make(map[string]map[string]message)
+	files, err := translationFiles.ReadDir("i18n")
+	if err != nil {
+		return translations, err
+	}
+	var errs []string
+	for _, file := range files {
+		lang := strings.TrimSuffix(file.Name(), ".yaml")
+		content, err := translationFiles.ReadFile(path.Join("i18n", file.Name()))
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		var translation map[string]message
+		if err := yaml.Unmarshal(content, &translation); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", file.Name(), err))
+			continue
+		}
+		translations[lang] = translation
+	}
+	if len(errs) > 0 {
+		return translations, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return translations, nil
+}
+
+// loadTranslationPacks merges the packs found in dir into translations. A pack
+// that can not be parsed is skipped, the other packs are still loaded.
+func loadTranslationPacks(dir string, translations map[string]map[string]message) ([]translationPack, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil || len(files) == 0 {
+		return nil, err
+	}
+	sort.Strings(files)
+	packs := []translationPack{}
+	var errs []string
+	for _, file := range files {
+		lang := strings.ReplaceAll(strings.TrimSuffix(filepath.Base(file), ".yaml"), "_", "-")
+		if _, err := language.Parse(lang); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %q is not a language tag", file, lang))
+			continue
+		}
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		var pack map[string]message
+		if err := yaml.Unmarshal(content, &pack); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", file, err))
+			continue
+		}
+		merged := make(map[string]message, len(translations[lang])+len(pack))
+		for key, m := range translations[lang] {
+			merged[key] = m
+		}
+		for key, m := range pack {
+			merged[key] = m
+		}
+		packs = append(packs, translationPack{
+			Language: lang,
+			Path:     file,
+			Warnings: validateTranslationPack(translations[fallbackLanguage], pack, merged),
+		})
+		translations[lang] = merged
+	}
+	if len(errs) > 0 {
+		return packs, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return packs, nil
+}
+
+// validateTranslationPack compares a pack with the English translation. Keys
+// English does not have and placeholders it does not fill are reported, as
+// well as the number of keys the language, merged with its built-in
+// translation, still shows in English.
+func validateTranslationPack(reference, pack, merged map[string]message) []string {
+	warnings := []string{}
+	keys := make([]string, 0, len(pack))
+	for key := range pack {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		ref, ok := reference[key]
+		if !ok {
+			warnings = append(warnings, "unknown key "+key)
+			continue
+		}
+		known := ref.placeholders()
+		for _, placeholder := range pack[key].placeholders() {
+			if !containsString(known, placeholder) {
+				warnings = append(warnings, fmt.Sprintf("%s: unknown placeholder {%s}", key, placeholder))
+			}
+		}
+	}
+	missing := 0
+	for key := range reference {
+		if _, ok := merged[key]; !ok {
+			missing++
+		}
+	}
+	if missing > 0 {
+		warnings = append(warnings, fmt.Sprintf("%d keys missing, English is shown instead", missing))
+	}
+	if _, ok := merged["languageName"]; !ok {
+		warnings = append(warnings, "no languageName, the language is listed by its tag")
+	}
+	return warnings
+}
+
+// watchTranslationPacks reloads the translations when a pack is added,
+// changed or removed, and then calls onChange. It polls so it works the same
+// on every platform and with editors that replace the file when saving.
+func watchTranslationPacks(interval time.Duration, onChange func()) {
+	snapshot := func() string {
+		files, _ := filepath.Glob(filepath.Join(translationPacksDir(), "*.yaml"))
+		var b strings.Builder
+		for _, file := range files {
+			if stat, err := os.Stat(file); err == nil {
+				fmt.Fprintf(&b, "%s %d %d\n", file, stat.Size(), stat.ModTime().UnixNano())
+			}
+		}
+		return b.String()
+	}
+	last := snapshot()
+	go func() {
+		for range time.Tick(interval) {
+			current := snapshot()
+			if current == last {
+				continue
+			}
+			last = current
+			if err := reloadTranslations(); err != nil {
+				slog.Error("Error reloading translations", "error", err)
+			}
+			onChange()
+		}
+	}()
+}
+
+// message is a translated text, either a plain string or a mapping of CLDR
+// plural categories to texts:
+//
+//	apkCount:
+//	  one: "{count} APK"
+//	  other: "{count} APKs"
+type message struct {
+	Text   string
+	Plural map[string]string
+}
+
+func (m *message) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.MappingNode {
+		if err := node.Decode(&m.Plural); err != nil {
+			return err
+		}
+		if _, ok := m.Plural["other"]; !ok {
+			return fmt.Errorf("line %d: plural forms need an \"other\" form", node.Line)
+		}
+		return nil
+	}
+	return node.Decode(&m.Text)
+}
+
+// Args are the values of the named placeholders of a translation.
+type Args map[string]interface{}
+
+var placeholderPattern = regexp.MustCompile(`\{([A-Za-z0-9_]+)\}`)
+
+// T returns the text of key in the current language, falling back to English
+// and then to the key itself so a missing translation never shows up empty.
+// Placeholders like {name} are replaced with the values of args, the "count"
+// argument selects the plural form.
+func T(key string, args ...Args) string {
+	values := Args{}
+	for _, a := range args {
+		for name, value := range a {
+			values[name] = value
+		}
+	}
+	translationsMu.RLock()
+	lang := currentLang
+	m, ok := translations[lang][key]
+	if !ok || m.empty() {
+		lang = fallbackLanguage
+		m, ok = translations[lang][key]
+	}
+	translationsMu.RUnlock()
+	if !ok || m.empty() {
+		return key
+	}
+	text := m.Text
+	if m.Plural != nil {
+		text = m.Plural["other"]
+		if form, ok := m.Plural[pluralCategory(lang, values["count"])]; ok {
+			text = form
+		}
+	}
+	if len(values) == 0 {
+		return text
+	}
+	return placeholderPattern.ReplaceAllStringFunc(text, func(placeholder string) string {
+		if value, ok := values[placeholder[1:len(placeholder)-1]]; ok {
+			return fmt.Sprint(value)
+		}
+		return placeholder
+	})
+}
+
+func (m message) empty() bool {
+	return m.Text == "" && m.Plural == nil
+}
+
+// placeholders returns the names of the placeholders used by the text and
+// its plural forms.
+func (m message) placeholders() []string {
+	names := []string{}
+	texts := []string{m.Text}
+	for _, text := range m.Plural {
+		texts = append(texts, text)
+	}
+	for _, text := range texts {
+		for _, match := range placeholderPattern.FindAllStringSubmatch(text, -1) {
+			names = append(names, match[1])
+		}
+	}
+	sort.Strings(names)
+	return uniqueStrings(names)
+}
+
+// translationIssues lists the keys of a language missing or not present in
+// the English file.
+type translationIssues struct {
+	Language string
+	Missing  []string
+	Extra    []string
+}
+
+// checkTranslations compares every language with the English file.
+func checkTranslations(translations map[string]map[string]message) []translationIssues {
+	reference := translations[fallbackLanguage]
+	languages := []string{}
+	for lang := range translations {
+		if lang != fallbackLanguage {
+			languages = append(languages, lang)
+		}
+	}
+	sort.Strings(languages)
+	result := []translationIssues{}
+	for _, lang := range languages {
+		issues := translationIssues{Language: lang}
+		for key := range reference {
+			if _, ok := translations[lang][key]; !ok {
+				issues.Missing = append(issues.Missing, key)
+			}
+		}
+		for key := range translations[lang] {
+			if _, ok := reference[key]; !ok {
+				issues.Extra = append(issues.Extra, key)
+			}
+		}
+		sort.Strings(issues.Missing)
+		sort.Strings(issues.Extra)
+		result = append(result, issues)
+	}
+	return result
+}
+
+// printTranslationIssues prints the report of checkTranslations and tells
+// whether all languages are complete.
+func printTranslationIssues(w io.Writer, result []translationIssues) bool {
+	complete := true
+	for _, issues := range result {
+		if len(issues.Missing) == 0 && len(issues.Extra) == 0 {
+			fmt.Fprintf(w, "%s: ok\n", issues.Language)
+			continue
+		}
+		complete = false
+		fmt.Fprintf(w, "%s: %d missing, %d extra\n", issues.Language, len(issues.Missing), len(issues.Extra))
+		for _, key := range issues.Missing {
+			fmt.Fprintf(w, "  - %s\n", key)
+		}
+		for _, key := range issues.Extra {
+			fmt.Fprintf(w, "  + %s\n", key)
+		}
+	}
+	return complete
+}
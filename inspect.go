@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// apkInfo is what we know about an APK before patching it.
+type apkInfo struct {
+	Package               string   `json:"package"`
+	VersionName           string   `json:"versionName,omitempty"`
+	VersionCode           string   `json:"versionCode,omitempty"`
+	MinSDK                string   `json:"minSdk,omitempty"`
+	TargetSDK             string   `json:"targetSdk,omitempty"`
+	MainActivity          string   `json:"mainActivity,omitempty"`
+	Permissions           []string `json:"permissions,omitempty"`
+	NetworkSecurityConfig string   `json:"networkSecurityConfig,omitempty"`
+	// NetworkSecurityConfigXML is the content of the existing config file
+	NetworkSecurityConfigXML string       `json:"networkSecurityConfigXml,omitempty"`
+	AppName                  string       `json:"appName,omitempty"`
+	ABIs                     []string     `json:"abis,omitempty"`
+	Signers                  []signerCert `json:"signers,omitempty"`
+	PinningLibraries         []string     `json:"pinningLibraries,omitempty"`
+	// Icon is the launcher icon as PNG or JPEG, empty for vector icons
+	Icon []byte `json:"-"`
+}
+
+type signerCert struct {
+	Subject string `json:"subject"`
+	SHA256  string `json:"sha256"`
+}
+
+// pinningSignature is a class or package of a library that can pin
+// certificates, matched against the dex files or the smali directories.
+type pinningSignature struct {
+	Name string
+	Path string
+	// Calls are call sites in smali that configure the pinning. A library
+	// with calls only pins when one is found, otherwise it is reported as
+	// present: OkHttp ships CertificatePinner with every client.
+	Calls []string
+	// ConfigTag in the network security config also configures the pinning
+	ConfigTag string
+	// Runtime marks runtimes with their own TLS stack, they are reported as
+	// present since they do not pin by themselves
+	Runtime bool
+}
+
+var pinningSignatures = []pinningSignature{
+	{Name: "OkHttp CertificatePinner", Path: "okhttp3/CertificatePinner", Calls: []string{"Lokhttp3/CertificatePinner$Builder;->add("}},
+	{Name: "OkHttp 2 CertificatePinner", Path: "com/squareup/okhttp/CertificatePinner", Calls: []string{"Lcom/squareup/okhttp/CertificatePinner$Builder;->add("}},
+	{Name: "TrustKit", Path: "com/datatheorem/android/trustkit", Calls: []string{"Lcom/datatheorem/android/trustkit/TrustKit;->initializeWithNetworkSecurityConfiguration("}, ConfigTag: "<trustkit-config"},
+	{Name: "Wultra SSL pinning", Path: "com/wultra/android/sslpinning"},
+	{Name: "Appcelerator PinningTrustManager", Path: "appcelerator/https/PinningTrustManager"},
+	{Name: "Cordova advanced HTTP", Path: "com/silkimen/cordovahttp", Runtime: true},
+	{Name: "Xamarin / Mono", Path: "mono/android", Runtime: true},
+}
+
+// libraryPresent is appended to the libraries found without a sign that they
+// pin.
+const libraryPresent = " (library present)"
+
+// iconDensities are tried in order when looking for the launcher icon.
+var iconDensities = []string{"xxxhdpi", "xxhdpi", "xhdpi", "hdpi", "mdpi", "ldpi", ""}
+
+// apktoolMeta is the part of apktool.yml we care about, apktool moves the
+// version and SDK attributes out of the manifest into this file.
+type apktoolMeta struct {
+	VersionInfo struct {
+		VersionCode string `yaml:"versionCode"`
+		VersionName string `yaml:"versionName"`
+	} `yaml:"versionInfo"`
+	SdkInfo struct {
+		MinSdkVersion    string `yaml:"minSdkVersion"`
+		TargetSdkVersion string `yaml:"targetSdkVersion"`
+	} `yaml:"sdkInfo"`
+}
+
+// decodeAPK runs apktool on the APK, decoding its resources and its sources
+// to smali.
+func decodeAPK(ctx context.Context, apkFile, outputDir string) error {
+	return runLogged(toolCommandContext(ctx, "apktool", "d", apkFile, "-f", "-o", outputDir), stageDecode)
+}
+
+// readManifest parses AndroidManifest.xml of a decoded APK and also returns
+// its raw content.
+func readManifest(decodedDir string) (manifest, []byte, error) {
+	var m manifest
+	content, err := ioutil.ReadFile(filepath.Join(decodedDir, "AndroidManifest.xml"))
+	if err != nil {
+		return m, nil, err
+	}
+	if err := xml.NewDecoder(bytes.NewBuffer(content)).Decode(&m); err != nil {
+		return m, content, errors.New(T("manifestParseFailed", Args{"error": err}))
+	}
+	return m, content, nil
+}
+
+func readApktoolMeta(decodedDir string) (apktoolMeta, error) {
+	var meta apktoolMeta
+	content, err := ioutil.ReadFile(filepath.Join(decodedDir, "apktool.yml"))
+	if err != nil {
+		return meta, err
+	}
+	// older apktool versions start the file with a java class tag
+	if strings.HasPrefix(string(content), "!!") {
+		if i := bytes.IndexByte(content, '\n'); i >= 0 {
+			content = content[i+1:]
+		}
+	}
+	err = yaml.Unmarshal(content, &meta)
+	return meta, err
+}
+
+// readAPKInfo collects the APK information from a decoded APK.
+func readAPKInfo(decodedDir string) (*apkInfo, error) {
+	m, _, err := readManifest(decodedDir)
+	if err != nil {
+		return nil, err
+	}
+	info := &apkInfo{
+		Package:               m.Package,
+		MainActivity:          m.mainActivity(),
+		NetworkSecurityConfig: m.Application.NetworkSecurityConfig,
+	}
+	for _, p := range m.UsesPermissions {
+		info.Permissions = append(info.Permissions, p.Name)
+	}
+	meta, err := readApktoolMeta(decodedDir)
+	if err != nil {
+		slog.Warn("Error reading apktool.yml", "error", err)
+	}
+	info.VersionCode = meta.VersionInfo.VersionCode
+	info.VersionName = meta.VersionInfo.VersionName
+	info.MinSDK = meta.SdkInfo.MinSdkVersion
+	info.TargetSDK = meta.SdkInfo.TargetSdkVersion
+
+	info.AppName = resolveString(decodedDir, m.Application.Label)
+	if info.NetworkSecurityConfig != "" {
+		content, err := ioutil.ReadFile(resourceFile(decodedDir, info.NetworkSecurityConfig, ".xml"))
+		if err != nil {
+			slog.Warn("Error reading network security config", "error", err)
+		}
+		info.NetworkSecurityConfigXML = string(content)
+	}
+	if icon := findIcon(decodedDir, m.Application.Icon); icon != "" {
+		info.Icon, _ = ioutil.ReadFile(icon)
+	}
+	if entries, err := os.ReadDir(filepath.Join(decodedDir, "lib")); err == nil {
+		for _, entry := range entries {
+			if entry.IsDir() {
+				info.ABIs = append(info.ABIs, entry.Name())
+			}
+		}
+	}
+	info.PinningLibraries = detectPinning(decodedDir, info)
+	return info, nil
+}
+
+// resourceFile maps a reference like @xml/network_security_config to its file
+// in the decoded resources.
+func resourceFile(decodedDir, ref, ext string) string {
+	ref = strings.TrimPrefix(ref, "@")
+	return filepath.Join(decodedDir, "res", filepath.Dir(ref), filepath.Base(ref)+ext)
+}
+
+// resolveString returns the value of a @string reference from the default
+// strings.xml, other values are returned as they are.
+func resolveString(decodedDir, ref string) string {
+	if !strings.HasPrefix(ref, "@string/") {
+		return ref
+	}
+	content, err := ioutil.ReadFile(filepath.Join(decodedDir, "res", "values", "strings.xml"))
+	if err != nil {
+		return ref
+	}
+	var resources struct {
+		Strings []struct {
+			Name  string `xml:"name,attr"`
+			Value string `xml:",chardata"`
+		} `xml:"string"`
+	}
+	if err := xml.Unmarshal(content, &resources); err != nil {
+		return ref
+	}
+	name := strings.TrimPrefix(ref, "@string/")
+	for _, s := range resources.Strings {
+		if s.Name == name {
+			return s.Value
+		}
+	}
+	return ref
+}
+
+// findIcon returns the highest density bitmap of the icon reference, adaptive
+// icons and vector drawables are skipped.
+func findIcon(decodedDir, ref string) string {
+	if !strings.HasPrefix(ref, "@") || !strings.Contains(ref, "/") {
+		return ""
+	}
+	parts := strings.SplitN(strings.TrimPrefix(ref, "@"), "/", 2)
+	for _, density := range iconDensities {
+		dir := parts[0]
+		if density != "" {
+			dir += "-" + density
+		}
+		for _, ext := range []string{".png", ".jpg"} {
+			matches, _ := filepath.Glob(filepath.Join(decodedDir, "res", dir+"*", parts[1]+ext))
+			if len(matches) > 0 {
+				return matches[0]
+			}
+		}
+	}
+	return ""
+}
+
+// detectPinning looks for certificate pinning in the smali directories of
+// the decoded APK, the library classes tell whether it is present and the
+// call sites whether it is configured.
+func detectPinning(decodedDir string, info *apkInfo) []string {
+	smaliDirs, _ := filepath.Glob(filepath.Join(decodedDir, "smali*"))
+
+	present := []pinningSignature{}
+	for _, sig := range pinningSignatures {
+		matched := false
+		for _, dir := range smaliDirs {
+			path := filepath.Join(dir, filepath.FromSlash(sig.Path))
+			if _, err := os.Stat(path); err == nil {
+				matched = true
+			} else if _, err := os.Stat(path + ".smali"); err == nil {
+				matched = true
+			}
+		}
+		if matched {
+			present = append(present, sig)
+		}
+	}
+	called := findSmaliCalls(smaliDirs, present)
+
+	found := []string{}
+	for _, sig := range present {
+		pins := !sig.Runtime && len(sig.Calls) == 0
+		for _, call := range sig.Calls {
+			pins = pins || called[call]
+		}
+		if sig.ConfigTag != "" && strings.Contains(info.NetworkSecurityConfigXML, sig.ConfigTag) {
+			pins = true
+		}
+		if pins {
+			found = append(found, sig.Name)
+		} else {
+			found = append(found, sig.Name+libraryPresent)
+		}
+	}
+	// flutter bundles its own TLS stack which ignores user CAs and proxies
+	if libs, _ := filepath.Glob(filepath.Join(decodedDir, "lib", "*", "libflutter.so")); len(libs) > 0 {
+		found = append(found, "Flutter")
+	}
+	if strings.Contains(info.NetworkSecurityConfigXML, "<pin-set") {
+		found = append(found, "Network security config pin-set")
+	}
+	return found
+}
+
+// findSmaliCalls tells which calls of the signatures occur in the smali
+// files, the classes of the library itself do not count.
+func findSmaliCalls(smaliDirs []string, sigs []pinningSignature) map[string]bool {
+	called := map[string]bool{}
+	pending := 0
+	for _, sig := range sigs {
+		pending += len(sig.Calls)
+	}
+	for _, dir := range smaliDirs {
+		if pending == 0 {
+			break
+		}
+		filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+			if err != nil || fi.IsDir() || !strings.HasSuffix(path, ".smali") {
+				return nil
+			}
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil
+			}
+			class := filepath.ToSlash(path)
+			for _, sig := range sigs {
+				if strings.Contains(class, "/"+sig.Path) {
+					continue
+				}
+				for _, call := range sig.Calls {
+					if !called[call] && bytes.Contains(content, []byte(call)) {
+						called[call] = true
+						pending--
+					}
+				}
+			}
+			if pending == 0 {
+				return filepath.SkipAll
+			}
+			return nil
+		})
+	}
+	return called
+}
+
+// readSigners lists the signing certificates of the APK, apksigner also
+// understands v2+ signatures, keytool only the JAR signature.
+func readSigners(ctx context.Context, apkFile string) ([]signerCert, error) {
+	if _, _, err := findTool("apksigner"); err == nil {
+		output, err := toolCommandContext(ctx, "apksigner", "verify", "--print-certs", apkFile).Output()
+		if err == nil {
+			return parseSigners(string(output), "certificate DN:", "certificate SHA-256 digest:"), nil
+		}
+		slog.Warn("Error running apksigner", "error", err)
+	}
+	output, err := toolCommandContext(ctx, "keytool", "-printcert", "-jarfile", apkFile).Output()
+	if err != nil {
+		return nil, err
+	}
+	return parseSigners(string(output), "Owner:", "SHA256:"), nil
+}
+
+// parseSigners reads the subject and SHA-256 lines of apksigner or keytool
+// output, a subject line starts a new certificate.
+func parseSigners(output, subjectPrefix, digestPrefix string) []signerCert {
+	signers := []signerCert{}
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if i := strings.Index(line, subjectPrefix); i >= 0 {
+			signers = append(signers, signerCert{Subject: strings.TrimSpace(line[i+len(subjectPrefix):])})
+		} else if i := strings.Index(line, digestPrefix); i >= 0 && len(signers) > 0 {
+			digest := strings.ReplaceAll(strings.TrimSpace(line[i+len(digestPrefix):]), ":", "")
+			signers[len(signers)-1].SHA256 = strings.ToLower(digest)
+		}
+	}
+	return signers
+}
+
+// inspectAPK decodes the APK into a temporary directory and reads its
+// information, the sources are decoded too for the pinning call sites.
+// Bundles are inspected through their base APK.
+func inspectAPK(ctx context.Context, apkFile string) (*apkInfo, error) {
+	tmpDir, err := ioutil.TempDir("", "apicker-inspect")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+	if isBundleFile(apkFile) {
+		apks, err := extractBundle(apkFile, filepath.Join(tmpDir, "apks"))
+		if err != nil {
+			return nil, err
+		}
+		apkFile = apks[0]
+	}
+	decodedDir := filepath.Join(tmpDir, "decoded")
+	if err := decodeAPK(ctx, apkFile, decodedDir); err != nil {
+		return nil, err
+	}
+	info, err := readAPKInfo(decodedDir)
+	if err != nil {
+		return nil, err
+	}
+	if info.Signers, err = readSigners(ctx, apkFile); err != nil {
+		slog.Warn("Error reading signers", "error", err)
+	}
+	return info, nil
+}
+
+func (info *apkInfo) manifest() manifest {
+	m := manifest{Package: info.Package}
+	m.Application.Activities = []manifestActivity{{Name: info.MainActivity}}
+	for _, p := range info.Permissions {
+		m.UsesPermissions = append(m.UsesPermissions, usesPermission{Name: p})
+	}
+	return m
+}
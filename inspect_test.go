@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDetectPinning(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		files map[string]string
+		nsc   string
+		want  []string
+	}{
+		{
+			name:  "okhttp without pins",
+			files: map[string]string{"smali/okhttp3/CertificatePinner.smali": ".class public final Lokhttp3/CertificatePinner;"},
+			want:  []string{"OkHttp CertificatePinner" + libraryPresent},
+		},
+		{
+			name: "okhttp with pins",
+			files: map[string]string{
+				"smali/okhttp3/CertificatePinner.smali":         "",
+				"smali/okhttp3/CertificatePinner$Builder.smali": "invoke-virtual {p0}, Lokhttp3/CertificatePinner$Builder;->add(Ljava/lang/String;[Ljava/lang/String;)Lokhttp3/CertificatePinner$Builder;",
+				"smali_classes2/com/example/Api.smali":          "invoke-virtual {v0, v1, v2}, Lokhttp3/CertificatePinner$Builder;->add(Ljava/lang/String;[Ljava/lang/String;)Lokhttp3/CertificatePinner$Builder;",
+			},
+			want: []string{"OkHttp CertificatePinner"},
+		},
+		{
+			name: "okhttp calling itself",
+			files: map[string]string{
+				"smali/okhttp3/CertificatePinner.smali":         "",
+				"smali/okhttp3/CertificatePinner$Builder.smali": "invoke-virtual {p0}, Lokhttp3/CertificatePinner$Builder;->add(Ljava/lang/String;[Ljava/lang/String;)Lokhttp3/CertificatePinner$Builder;",
+			},
+			want: []string{"OkHttp CertificatePinner" + libraryPresent},
+		},
+		{
+			name:  "trustkit config",
+			files: map[string]string{"smali/com/datatheorem/android/trustkit/TrustKit.smali": ""},
+			nsc:   `<network-security-config><trustkit-config enforcePinning="true"/></network-security-config>`,
+			want:  []string{"TrustKit"},
+		},
+		{
+			name:  "xamarin runtime",
+			files: map[string]string{"smali/mono/android/Runtime.smali": ".class public Lmono/android/Runtime;"},
+			want:  []string{"Xamarin / Mono" + libraryPresent},
+		},
+		{
+			name: "pin-set",
+			nsc:  `<network-security-config><domain-config><pin-set><pin digest="SHA-256">x</pin></pin-set></domain-config></network-security-config>`,
+			want: []string{"Network security config pin-set"},
+		},
+	} {
+		dir := t.TempDir()
+		for name, content := range test.files {
+			path := filepath.Join(dir, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got := detectPinning(dir, &apkInfo{NetworkSecurityConfigXML: test.nsc})
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: detectPinning() = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/canvas"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/layout"
+	"fyne.io/fyne/v2/widget"
+)
+
+// inspectorFields are the translation keys of the rows of the inspector panel.
+var inspectorFields = []string{"inspectPackage", "inspectVersion", "inspectSDK", "inspectABIs", "inspectSigners", "inspectNSC", "inspectPinning"}
+
+// inspectorPanel shows what is inside the selected APK before it is patched.
+type inspectorPanel struct {
+	status   *textKey
+	icon     *canvas.Image
+	appName  *widget.Label
+	values   map[string]*textKey
+	nscEntry *widget.Entry
+	content  fyne.CanvasObject
+
+	mu        sync.Mutex
+	inspected string
+	cancel    context.CancelFunc
+}
+
+func newInspectorPanel(texts *textScope) *inspectorPanel {
+	title := texts.label("inspector")
+	title.TextStyle = fyne.TextStyle{Bold: true}
+	status := widget.NewLabel("")
+	p := &inspectorPanel{
+		status:   texts.keyed(status.SetText),
+		icon:     canvas.NewImageFromResource(nil),
+		appName:  widget.NewLabelWithStyle("", fyne.TextAlignLeading, fyne.TextStyle{Bold: true}),
+		values:   make(map[string]*textKey),
+		nscEntry: widget.NewMultiLineEntry(),
+	}
+	p.icon.FillMode = canvas.ImageFillContain
+	p.icon.SetMinSize(fyne.NewSize(64, 64))
+	p.nscEntry.Disable()
+	p.nscEntry.SetMinRowsVisible(8)
+
+	rows := container.New(layout.NewFormLayout())
+	for _, key := range inspectorFields {
+		value := widget.NewLabel("")
+		value.Wrapping = fyne.TextWrapWord
+		p.values[key] = texts.keyed(value.SetText)
+		rows.Add(texts.label(key))
+		rows.Add(value)
+	}
+	p.content = container.NewVScroll(container.NewVBox(
+		title,
+		container.NewHBox(p.icon, container.NewVBox(p.appName, status)),
+		rows,
+		texts.label("inspectNSCContent"),
+		p.nscEntry,
+	))
+	return p
+}
+
+// inspect reads the APK in the background, a newer selection cancels the
+// running inspection. Paths that are not input files are ignored.
+func (p *inspectorPanel) inspect(path string) {
+	if stat, err := os.Stat(path); err != nil || stat.IsDir() || !isInputFile(path) {
+		return
+	}
+	p.mu.Lock()
+	if path == p.inspected {
+		p.mu.Unlock()
+		return
+	}
+	if p.cancel != nil {
+		p.cancel()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p.inspected, p.cancel = path, cancel
+	p.mu.Unlock()
+
+	p.clear()
+	p.status.SetKey("inspecting")
+	go func() {
+		defer cancel()
+		info, err := inspectAPK(ctx, path)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			p.status.SetKey("error", Args{"error": err})
+			p.mu.Lock()
+			p.inspected = ""
+			p.mu.Unlock()
+			return
+		}
+		p.status.SetKey("")
+		p.show(info)
+	}()
+}
+
+func (p *inspectorPanel) clear() {
+	p.icon.Resource = nil
+	p.icon.Refresh()
+	p.appName.SetText("")
+	for _, key := range inspectorFields {
+		p.values[key].SetKey("")
+	}
+	p.nscEntry.SetText("")
+}
+
+func (p *inspectorPanel) show(info *apkInfo) {
+	if len(info.Icon) > 0 {
+		p.icon.Resource = fyne.NewStaticResource(info.Package+"_icon", info.Icon)
+		p.icon.Refresh()
+	}
+	p.appName.SetText(info.AppName)
+	p.setValue("inspectPackage", info.Package)
+	p.setValue("inspectVersion", fmt.Sprintf("%s (%s)", info.VersionName, info.VersionCode))
+	p.setValue("inspectSDK", info.MinSDK+" / "+info.TargetSDK)
+	p.setValue("inspectABIs", strings.Join(info.ABIs, ", "))
+	signers := []string{}
+	for _, signer := range info.Signers {
+		signers = append(signers, signer.Subject+"\nSHA-256 "+signer.SHA256)
+	}
+	p.setValue("inspectSigners", strings.Join(signers, "\n"))
+	p.setValue("inspectNSC", info.NetworkSecurityConfig)
+	p.setValue("inspectPinning", strings.Join(info.PinningLibraries, "\n"))
+	p.nscEntry.SetText(info.NetworkSecurityConfigXML)
+}
+
+// setValue shows value in the row of key, or the translation of "none" when
+// it is empty.
+func (p *inspectorPanel) setValue(key, value string) {
+	if value == "" {
+		p.values[key].SetKey("none")
+		return
+	}
+	p.values[key].SetText(value)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// LaunchOptions controls the check that the app is still running after start.
+type LaunchOptions struct {
+	SkipVerify  bool `yaml:"skipVerify,omitempty"`
+	WaitSeconds int  `yaml:"waitSeconds,omitempty"`
+}
+
+const defaultLaunchWaitSeconds = 5
+
+// at most this many lines of the native crash dump are kept
+const maxTombstoneLines = 40
+
+type crashReport struct {
+	Package    string   `json:"package"`
+	Device     string   `json:"device"`
+	StackTrace []string `json:"stackTrace,omitempty"`
+	Tombstone  []string `json:"tombstone,omitempty"`
+}
+
+func (c *crashReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s crashed on %s\n", c.Package, c.Device)
+	if len(c.StackTrace) > 0 {
+		b.WriteString("\nAndroidRuntime:\n")
+		b.WriteString(strings.Join(c.StackTrace, "\n"))
+		b.WriteString("\n")
+	}
+	if len(c.Tombstone) > 0 {
+		b.WriteString("\nTombstone:\n")
+		b.WriteString(strings.Join(c.Tombstone, "\n"))
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// deviceTimeArgs are the adb arguments of getDeviceTime. adb shell joins its
+// arguments with spaces, so the format is quoted for the device shell.
+func deviceTimeArgs(device string) []string {
+	return []string{"-s", device, "shell", "date", "'+%m-%d %H:%M:%S.000'"}
+}
+
+// getDeviceTime returns the device clock in the format accepted by logcat -T.
+func getDeviceTime(device string) (string, error) {
+	output, err := toolCommand("adb", deviceTimeArgs(device)...).Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// clearCrashLog empties the log buffers read by collectCrash, so that without
+// the device time it only finds the lines of the next launch.
+func clearCrashLog(device string) error {
+	return toolCommand("adb", "-s", device, "logcat", "-c", "-b", "main", "-b", "crash").Run()
+}
+
+// verifyLaunch waits for the app to settle and returns a crash report when its
+// process is gone, since is the device time taken before the launch.
+func verifyLaunch(ctx context.Context, device, packageName, since string, opts LaunchOptions) (*crashReport, error) {
+	wait := opts.WaitSeconds
+	if wait <= 0 {
+		wait = defaultLaunchWaitSeconds
+	}
+	slog.Info("Verifying launch", "package", packageName)
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(time.Duration(wait) * time.Second):
+	}
+	if _, err := getAppPID(device, packageName, 0); err == nil {
+		return nil, nil
+	}
+	return collectCrash(device, packageName, since)
+}
+
+// collectCrash reads the AndroidRuntime stack trace and the native crash dump
+// written since the given device time, the whole buffer when since is empty.
+func collectCrash(device, packageName, since string) (*crashReport, error) {
+	args := []string{"-s", device, "logcat", "-d", "-b", "main", "-b", "crash", "-v", "brief"}
+	if since != "" {
+		args = append(args, "-T", since)
+	}
+	args = append(args, "AndroidRuntime:E", "DEBUG:F", "*:S")
+	output, err := toolCommand("adb", args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("reading crash log: %v", err)
+	}
+	return parseCrashLog(string(output), packageName, device), nil
+}
+
+// debugPIDPattern takes the PID of the crash_dump process from a DEBUG line,
+// the lines of one dump share it.
+var debugPIDPattern = regexp.MustCompile(`/DEBUG\s*\(\s*(\d+)\)`)
+
+// parseCrashLog keeps the AndroidRuntime blocks and the native crash dumps of
+// the package, crashes of other apps end up in the same buffers.
+func parseCrashLog(output, packageName, device string) *crashReport {
+	report := &crashReport{Package: packageName, Device: device}
+	var block []string
+	matched := false
+	dumps := map[string][]string{}
+	dumpOrder := []string{}
+	flush := func() {
+		if matched {
+			report.StackTrace = append(report.StackTrace, block...)
+		}
+		block = nil
+		matched = false
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimRight(line, "\r")
+		switch {
+		case strings.Contains(line, "/AndroidRuntime"):
+			if strings.Contains(line, "FATAL EXCEPTION") {
+				flush()
+			}
+			if strings.Contains(line, "Process: "+packageName+",") || strings.Contains(line, "Process: "+packageName+":") {
+				matched = true
+			}
+			block = append(block, line)
+		case strings.Contains(line, "/DEBUG"):
+			pid := ""
+			if m := debugPIDPattern.FindStringSubmatch(line); m != nil {
+				pid = m[1]
+			}
+			if _, ok := dumps[pid]; !ok {
+				dumpOrder = append(dumpOrder, pid)
+			}
+			dumps[pid] = append(dumps[pid], line)
+		}
+	}
+	flush()
+	// 只保留本应用的崩溃转储，转储里有一行 "pid: 1234, ... >>> 包名 <<<"
+	for _, pid := range dumpOrder {
+		if !isDumpOf(dumps[pid], packageName) {
+			continue
+		}
+		for _, line := range dumps[pid] {
+			if len(report.Tombstone) < maxTombstoneLines {
+				report.Tombstone = append(report.Tombstone, line)
+			}
+		}
+	}
+	return report
+}
+
+// isDumpOf tells whether the native crash dump is of a process of the
+// package, also ":service" processes count.
+func isDumpOf(dump []string, packageName string) bool {
+	for _, line := range dump {
+		if strings.Contains(line, ">>> "+packageName+" <<<") || strings.Contains(line, ">>> "+packageName+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// saveCrashReport writes the report into dir, next to the signed APK.
+func saveCrashReport(dir string, report *crashReport) (string, error) {
+	path := filepath.Join(dir, fmt.Sprintf("%s_crash.txt", report.Package))
+	return path, ioutil.WriteFile(path, []byte(report.String()), 0644)
+}
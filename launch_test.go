@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os/exec"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+const crashLog = `E/AndroidRuntime( 4321): FATAL EXCEPTION: main
+E/AndroidRuntime( 4321): Process: com.other.app, PID: 4321
+E/AndroidRuntime( 4321): java.lang.IllegalStateException: other
+E/AndroidRuntime( 5555): FATAL EXCEPTION: main
+E/AndroidRuntime( 5555): Process: com.example.app, PID: 5555
+E/AndroidRuntime( 5555): java.lang.NullPointerException
+F/DEBUG   ( 7001): *** *** *** *** *** *** *** *** *** *** *** *** *** *** *** ***
+F/DEBUG   ( 7001): pid: 6000, tid: 6000, name: other  >>> com.other.app <<<
+F/DEBUG   ( 7002): *** *** *** *** *** *** *** *** *** *** *** *** *** *** *** ***
+F/DEBUG   ( 7001): signal 11 (SIGSEGV)
+F/DEBUG   ( 7002): pid: 6100, tid: 6120, name: Thread-2  >>> com.example.app:remote <<<
+F/DEBUG   ( 7002): signal 6 (SIGABRT)
+`
+
+func TestParseCrashLogKeepsPackageCrashes(t *testing.T) {
+	report := parseCrashLog(crashLog, "com.example.app", "emulator-5554")
+	wantTrace := []string{
+		"E/AndroidRuntime( 5555): FATAL EXCEPTION: main",
+		"E/AndroidRuntime( 5555): Process: com.example.app, PID: 5555",
+		"E/AndroidRuntime( 5555): java.lang.NullPointerException",
+	}
+	if !reflect.DeepEqual(report.StackTrace, wantTrace) {
+		t.Errorf("stack trace = %q, want %q", report.StackTrace, wantTrace)
+	}
+	wantTombstone := []string{
+		"F/DEBUG   ( 7002): *** *** *** *** *** *** *** *** *** *** *** *** *** *** *** ***",
+		"F/DEBUG   ( 7002): pid: 6100, tid: 6120, name: Thread-2  >>> com.example.app:remote <<<",
+		"F/DEBUG   ( 7002): signal 6 (SIGABRT)",
+	}
+	if !reflect.DeepEqual(report.Tombstone, wantTombstone) {
+		t.Errorf("tombstone = %q, want %q", report.Tombstone, wantTombstone)
+	}
+
+	if report := parseCrashLog(crashLog, "com.example", "emulator-5554"); len(report.StackTrace)+len(report.Tombstone) > 0 {
+		t.Errorf("prefix of the package matched: %+v", report)
+	}
+}
+
+func TestDeviceTimeCommandLine(t *testing.T) {
+	args := deviceTimeArgs("emulator-5554")
+	if !reflect.DeepEqual(args[:3], []string{"-s", "emulator-5554", "shell"}) {
+		t.Fatalf("args = %q, want a shell command of emulator-5554", args)
+	}
+	// adb shell joins the arguments with spaces before the device shell
+	// splits them again
+	line := strings.Join(args[3:], " ")
+	if want := "date '+%m-%d %H:%M:%S.000'"; line != want {
+		t.Errorf("command line = %q, want %q", line, want)
+	}
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no sh to run the command line")
+	}
+	output, err := exec.Command(sh, "-c", line).Output()
+	if err != nil {
+		t.Fatalf("running %q: %v", line, err)
+	}
+	if got := strings.TrimSpace(string(output)); !regexp.MustCompile(`^\d\d-\d\d \d\d:\d\d:\d\d\.000$`).MatchString(got) {
+		t.Errorf("device time = %q, want the format of logcat -T", got)
+	}
+}
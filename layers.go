@@ -0,0 +1,442 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
+)
+
+// projectConfigFile is looked up in the working directory and next to the
+// input APK, it holds settings of the project shared with the team.
+const projectConfigFile = "apicker.yml"
+
+const (
+	sourceDefault = "default"
+	sourceUser    = "user"
+	sourceEnv     = "env"
+	sourceFlag    = "flag"
+)
+
+// settings are the effective language, font, tool paths, active profile and
+// the fields of the active profile, keyed by their dotted YAML path like "emulator.avd".
+type settings map[string]interface{}
+
+// configLayer is one source of settings, later layers override earlier ones.
+type configLayer struct {
+	Source string
+	Values settings
+}
+
+var (
+	// configInputs are the input files whose directory may hold a project config
+	configInputs []string
+	// profileFlag is the profile selected with --profile
+	profileFlag string
+	// configSources tells where each effective setting came from
+	configSources = map[string]string{}
+	// configOverrides are the settings taken from another layer than the user
+	// config and configUserValues what the user config had for them, saveConfig
+	// writes the user values back as long as the override is unchanged
+	configOverrides  settings
+	configUserValues settings
+)
+
+// settingKeys returns the known settings and their types.
+func settingKeys() map[string]reflect.Type {
+	keys := map[string]reflect.Type{
+		"language":      reflect.TypeOf(""),
+		"font":          reflect.TypeOf(""),
+		"activeProfile": reflect.TypeOf(""),
+	}
+	addStructKeys(keys, "tools", reflect.TypeOf(ToolPaths{}))
+	addStructKeys(keys, "", reflect.TypeOf(Profile{}))
+	return keys
+}
+
+func addStructKeys(keys map[string]reflect.Type, prefix string, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+		if field.Type.Kind() == reflect.Struct {
+			addStructKeys(keys, name, field.Type)
+		} else {
+			keys[name] = field.Type
+		}
+	}
+}
+
+// flattenSettings turns nested YAML values into dotted keys, unknown keys are
+// logged and skipped.
+func flattenSettings(prefix string, values map[string]interface{}, keys map[string]reflect.Type, out settings) {
+	for k, v := range values {
+		path := k
+		if prefix != "" {
+			path = prefix + "." + k
+		}
+		if _, ok := keys[path]; ok {
+			out[path] = v
+		} else if nested, ok := v.(map[string]interface{}); ok {
+			flattenSettings(path, nested, keys, out)
+		} else {
+			slog.Warn("Unknown config key", "key", path)
+		}
+	}
+}
+
+// currentSettings returns the settings of the loaded config.
+func currentSettings() settings {
+	s := settings{}
+	content, err := yaml.Marshal(config.profile())
+	if err != nil {
+		slog.Error("Error reading profile", "error", err)
+		return s
+	}
+	values := map[string]interface{}{}
+	yaml.Unmarshal(content, &values)
+	flattenSettings("", values, settingKeys(), s)
+	if config.Language != "" {
+		s["language"] = config.Language
+	}
+	if config.Font != "" {
+		s["font"] = config.Font
+	}
+	for key := range settingKeys() {
+		if name := strings.TrimPrefix(key, "tools."); name != key {
+			if path := config.Tools.path(name); path != "" {
+				s[key] = path
+			}
+		}
+	}
+	s["activeProfile"] = config.ActiveProfile
+	return s
+}
+
+// profileFromSettings builds a profile from the profile fields of s.
+func profileFromSettings(s settings) (*Profile, error) {
+	nested := map[string]interface{}{}
+	for key, value := range s {
+		if key == "language" || key == "font" || key == "activeProfile" || strings.HasPrefix(key, "tools.") {
+			continue
+		}
+		parts := strings.Split(key, ".")
+		m := nested
+		for _, part := range parts[:len(parts)-1] {
+			if _, ok := m[part].(map[string]interface{}); !ok {
+				m[part] = map[string]interface{}{}
+			}
+			m = m[part].(map[string]interface{})
+		}
+		m[parts[len(parts)-1]] = value
+	}
+	content, err := yaml.Marshal(nested)
+	if err != nil {
+		return nil, err
+	}
+	p := &Profile{}
+	return p, yaml.Unmarshal(content, p)
+}
+
+func defaultLayer() configLayer {
+	return configLayer{Source: sourceDefault, Values: settings{
+		"keystore":             defaultKeyStore,
+		"keyAlias":             defaultKeyAlias,
+		"dname":                defaultDName,
+		"launch.waitSeconds":   defaultLaunchWaitSeconds,
+		"emulator.bootTimeout": defaultBootTimeoutSeconds,
+	}}
+}
+
+// projectConfigPaths returns the project config files of the working
+// directory and of the input directories, in that order.
+func projectConfigPaths() []string {
+	dirs := []string{"."}
+	for _, input := range configInputs {
+		dirs = append(dirs, filepath.Dir(input))
+	}
+	paths := []string{}
+	seen := make(map[string]bool)
+	for _, dir := range dirs {
+		path, err := filepath.Abs(filepath.Join(dir, projectConfigFile))
+		if err != nil || seen[path] {
+			continue
+		}
+		seen[path] = true
+		if _, err := os.Stat(path); err == nil && path != getConfigFilePath() {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+func readProjectLayer(path string) (configLayer, error) {
+	layer := configLayer{Source: path, Values: settings{}}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return layer, err
+	}
+	values := map[string]interface{}{}
+	if err := yaml.Unmarshal(content, &values); err != nil {
+		return layer, err
+	}
+	flattenSettings("", values, settingKeys(), layer.Values)
+	// a project config may come with the input files, it must not make apicker
+	// run other programs
+	for key := range layer.Values {
+		if strings.HasPrefix(key, "tools.") {
+			slog.Warn("Tool paths are ignored in project configs", "path", path, "key", key)
+			delete(layer.Values, key)
+		}
+	}
+	return layer, nil
+}
+
+// envName maps a setting to its environment variable, emulator.systemCA is
+// read from APICKER_EMULATOR_SYSTEM_CA.
+func envName(key string) string {
+	var b strings.Builder
+	b.WriteString("APICKER_")
+	prev := rune(0)
+	for _, r := range key {
+		switch {
+		case r == '.':
+			b.WriteByte('_')
+		case unicode.IsUpper(r) && unicode.IsLower(prev):
+			b.WriteByte('_')
+			b.WriteRune(r)
+		default:
+			b.WriteRune(unicode.ToUpper(r))
+		}
+		prev = r
+	}
+	return b.String()
+}
+
+func envLayer() configLayer {
+	layer := configLayer{Source: sourceEnv, Values: settings{}}
+	for key, t := range settingKeys() {
+		raw, ok := os.LookupEnv(envName(key))
+		if !ok {
+			continue
+		}
+		value, err := parseSettingValue(t, raw)
+		if err != nil {
+			slog.Warn("Error reading environment variable", "name", envName(key), "error", err)
+			continue
+		}
+		layer.Values[key] = value
+	}
+	return layer
+}
+
+// parseSettingValue converts the text of an environment variable, lists are
+// comma separated.
+func parseSettingValue(t reflect.Type, raw string) (interface{}, error) {
+	switch t.Kind() {
+	case reflect.Slice:
+		items := []interface{}{}
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		return items, nil
+	case reflect.Bool:
+		return strconv.ParseBool(raw)
+	case reflect.Int:
+		return strconv.Atoi(raw)
+	case reflect.String:
+		return raw, nil
+	}
+	return nil, fmt.Errorf("%s values can not be set from the environment", t.Kind())
+}
+
+// userConfig returns the config with the values of the user config file in
+// place of the unchanged overrides of the other layers.
+func userConfig() Config {
+	s := currentSettings()
+	for key, value := range configOverrides {
+		if !reflect.DeepEqual(s[key], value) {
+			continue
+		}
+		if userValue, ok := configUserValues[key]; ok {
+			s[key] = userValue
+		} else {
+			delete(s, key)
+		}
+	}
+	saved := config
+	saved.Profiles = make(map[string]*Profile, len(config.Profiles))
+	for name, p := range config.Profiles {
+		saved.Profiles[name] = p
+	}
+	if p, err := profileFromSettings(s); err == nil {
+		saved.Profiles[config.ActiveProfile] = p
+	} else {
+		slog.Error("Error restoring profile", "error", err)
+	}
+	saved.Language, _ = s["language"].(string)
+	saved.Font, _ = s["font"].(string)
+	saved.Tools = toolsFromSettings(s)
+	saved.ActiveProfile, _ = s["activeProfile"].(string)
+	return saved
+}
+
+// setConfigInputs reloads the layers when the input files changed, it tells
+// whether they did.
+func setConfigInputs(inputs ...string) bool {
+	if reflect.DeepEqual(inputs, configInputs) {
+		return false
+	}
+	configInputs = inputs
+	applyConfigLayers()
+	return true
+}
+
+// applyConfigLayers computes the effective settings: built-in defaults < user
+// config < project config < APICKER_* environment variables < --profile.
+// Other command line flags are bound to the result and override it.
+func applyConfigLayers() {
+	config = userConfig()
+	configOverrides, configUserValues = nil, nil
+
+	layers := []configLayer{}
+	for _, path := range projectConfigPaths() {
+		layer, err := readProjectLayer(path)
+		if err != nil {
+			slog.Warn("Error reading project config", "path", path, "error", err)
+			continue
+		}
+		layers = append(layers, layer)
+	}
+	layers = append(layers, envLayer())
+	if profileFlag != "" {
+		layers = append(layers, configLayer{Source: sourceFlag, Values: settings{"activeProfile": profileFlag}})
+	}
+
+	// the active profile decides which user values are used
+	userActive := config.ActiveProfile
+	for _, layer := range layers {
+		if name, ok := layer.Values["activeProfile"].(string); ok && name != "" {
+			if _, exists := config.Profiles[name]; exists {
+				config.ActiveProfile = name
+			} else {
+				slog.Warn("Unknown profile", "source", layer.Source, "profile", name)
+			}
+		}
+	}
+	user := currentSettings()
+	user["activeProfile"] = userActive
+
+	merged := settings{}
+	sources := map[string]string{}
+	all := append([]configLayer{defaultLayer(), {Source: sourceUser, Values: user}}, layers...)
+	for _, layer := range all {
+		for key, value := range layer.Values {
+			if key == "activeProfile" {
+				continue
+			}
+			merged[key] = value
+			sources[key] = layer.Source
+			if layer.Source == sourceEnv {
+				sources[key] = sourceEnv + " " + envName(key)
+			}
+		}
+	}
+	merged["activeProfile"] = config.ActiveProfile
+	sources["activeProfile"] = sourceUser
+	if config.ActiveProfile != userActive {
+		for _, layer := range layers {
+			if layer.Values["activeProfile"] == config.ActiveProfile {
+				sources["activeProfile"] = layer.Source
+			}
+		}
+	}
+
+	p, err := profileFromSettings(merged)
+	if err != nil {
+		slog.Error("Error applying config layers", "error", err)
+		return
+	}
+	*config.profile() = *p
+	if language, ok := merged["language"].(string); ok {
+		config.Language = language
+	}
+	if font, ok := merged["font"].(string); ok {
+		config.Font = font
+	}
+	config.Tools = toolsFromSettings(merged)
+	configSources = sources
+	configOverrides, configUserValues = settings{}, settings{}
+	for key, source := range sources {
+		if source == sourceUser {
+			continue
+		}
+		configOverrides[key] = merged[key]
+		if value, ok := user[key]; ok {
+			configUserValues[key] = value
+		}
+	}
+	configOverrides["activeProfile"] = config.ActiveProfile
+	configUserValues["activeProfile"] = userActive
+}
+
+// inputArgs picks the input files out of command line arguments.
+func inputArgs(args []string) []string {
+	inputs := []string{}
+	for _, arg := range args {
+		if i := strings.Index(arg, "="); strings.HasPrefix(arg, "-") && i >= 0 {
+			arg = arg[i+1:]
+		}
+		if isInputFile(arg) {
+			inputs = append(inputs, arg)
+		}
+	}
+	return inputs
+}
+
+// sortedSettingKeys returns the known settings in a stable order.
+func sortedSettingKeys() []string {
+	keys := []string{}
+	for key := range settingKeys() {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatSetting prints a setting value on one line.
+func formatSetting(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case []interface{}:
+		items := []string{}
+		for _, item := range v {
+			items = append(items, fmt.Sprint(item))
+		}
+		return strings.Join(items, ",")
+	case map[string]interface{}:
+		items := []string{}
+		for k, item := range v {
+			items = append(items, fmt.Sprintf("%s=%v", k, item))
+		}
+		sort.Strings(items)
+		return strings.Join(items, ",")
+	}
+	return fmt.Sprint(value)
+}
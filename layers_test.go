@@ -0,0 +1,177 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// useTestConfig points the config file to a temporary home directory and
+// restores the config globals when the test ends.
+func useTestConfig(t *testing.T) string {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	for key := range settingKeys() {
+		if _, ok := os.LookupEnv(envName(key)); ok {
+			t.Setenv(envName(key), "")
+			os.Unsetenv(envName(key))
+		}
+	}
+	savedConfig, savedReadOnly, savedLoadError := config, configReadOnly, configLoadError
+	savedInputs, savedProfileFlag := configInputs, profileFlag
+	savedSources, savedOverrides, savedUserValues := configSources, configOverrides, configUserValues
+	t.Cleanup(func() {
+		config, configReadOnly, configLoadError = savedConfig, savedReadOnly, savedLoadError
+		configInputs, profileFlag = savedInputs, savedProfileFlag
+		configSources, configOverrides, configUserValues = savedSources, savedOverrides, savedUserValues
+	})
+	config, configReadOnly, configLoadError = Config{}, false, nil
+	configInputs, profileFlag = nil, ""
+	configSources, configOverrides, configUserValues = map[string]string{}, nil, nil
+	return home
+}
+
+func TestConfigLayerPrecedence(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		project     string
+		env         map[string]string
+		profile     string
+		wantKeys    map[string]interface{}
+		wantSources map[string]string
+	}{
+		{
+			name:        "user",
+			wantKeys:    map[string]interface{}{"keystore": "user.jks", "keyAlias": defaultKeyAlias, "activeProfile": defaultProfileName},
+			wantSources: map[string]string{"keystore": sourceUser, "keyAlias": sourceDefault, "activeProfile": sourceUser},
+		},
+		{
+			name:        "project over user",
+			project:     "keystore: project.jks\nemulator:\n  avd: Pixel\ntools:\n  adb: /tmp/evil\n",
+			wantKeys:    map[string]interface{}{"keystore": "project.jks", "emulator.avd": "Pixel", "tools.adb": nil},
+			wantSources: map[string]string{"keystore": "project", "emulator.avd": "project", "tools.adb": ""},
+		},
+		{
+			name:        "env over project",
+			project:     "keystore: project.jks\n",
+			env:         map[string]string{"APICKER_KEYSTORE": "env.jks", "APICKER_LAUNCH_WAIT_SECONDS": "9"},
+			wantKeys:    map[string]interface{}{"keystore": "env.jks", "launch.waitSeconds": 9},
+			wantSources: map[string]string{"keystore": "env APICKER_KEYSTORE", "launch.waitSeconds": "env APICKER_LAUNCH_WAIT_SECONDS"},
+		},
+		{
+			name:        "profile flag over env",
+			env:         map[string]string{"APICKER_ACTIVE_PROFILE": "missing", "APICKER_KEY_ALIAS": "env"},
+			profile:     "work",
+			wantKeys:    map[string]interface{}{"keystore": "work.jks", "keyAlias": "env", "activeProfile": "work"},
+			wantSources: map[string]string{"keystore": sourceUser, "keyAlias": "env APICKER_KEY_ALIAS", "activeProfile": sourceFlag},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			useTestConfig(t)
+			config = Config{
+				ActiveProfile: defaultProfileName,
+				Profiles: map[string]*Profile{
+					defaultProfileName: {Keystore: "user.jks"},
+					"work":             {Keystore: "work.jks"},
+				},
+			}
+			projectPath := ""
+			if test.project != "" {
+				dir := t.TempDir()
+				projectPath = filepath.Join(dir, projectConfigFile)
+				if err := ioutil.WriteFile(projectPath, []byte(test.project), 0644); err != nil {
+					t.Fatal(err)
+				}
+				configInputs = []string{filepath.Join(dir, "app.apk")}
+			}
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			profileFlag = test.profile
+
+			applyConfigLayers()
+			values := currentSettings()
+			for key, want := range test.wantKeys {
+				if got := values[key]; got != want {
+					t.Errorf("%s = %v, want %v", key, got, want)
+				}
+			}
+			for key, want := range test.wantSources {
+				if want == "project" {
+					want = projectPath
+				}
+				if got := configSources[key]; got != want {
+					t.Errorf("source of %s = %q, want %q", key, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestUserConfigRoundTrip(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		profile string
+		change  func()
+		want    Profile
+		active  string
+	}{
+		{
+			name:   "overrides are not saved",
+			change: func() {},
+			want:   Profile{Keystore: "user.jks", KeyAlias: "user"},
+			active: defaultProfileName,
+		},
+		{
+			name:   "changed overrides are saved",
+			change: func() { config.profile().Keystore = "changed.jks" },
+			want:   Profile{Keystore: "changed.jks", KeyAlias: "user"},
+			active: defaultProfileName,
+		},
+		{
+			name:   "user values are saved",
+			change: func() { config.profile().DName = "CN=Test" },
+			want:   Profile{Keystore: "user.jks", KeyAlias: "user", DName: "CN=Test"},
+			active: defaultProfileName,
+		},
+		{
+			name:    "profile flag is not saved",
+			profile: "work",
+			change:  func() {},
+			want:    Profile{Keystore: "user.jks", KeyAlias: "user"},
+			active:  defaultProfileName,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			useTestConfig(t)
+			config = Config{
+				ActiveProfile: defaultProfileName,
+				Profiles: map[string]*Profile{
+					defaultProfileName: {Keystore: "user.jks", KeyAlias: "user"},
+					"work":             {Keystore: "work.jks"},
+				},
+			}
+			t.Setenv("APICKER_KEYSTORE", "env.jks")
+			profileFlag = test.profile
+			applyConfigLayers()
+			if got := config.profile().Keystore; got != "env.jks" {
+				t.Fatalf("effective keystore = %q, want env.jks", got)
+			}
+			test.change()
+
+			saved := userConfig()
+			if saved.ActiveProfile != test.active {
+				t.Errorf("active profile = %q, want %q", saved.ActiveProfile, test.active)
+			}
+			p := saved.Profiles[test.active]
+			if p.Keystore != test.want.Keystore || p.KeyAlias != test.want.KeyAlias || p.DName != test.want.DName {
+				t.Errorf("saved profile = %+v, want %+v", *p, test.want)
+			}
+			if work := saved.Profiles["work"]; work == nil || work.Keystore != "work.jks" {
+				t.Errorf("other profile = %+v, want it unchanged", work)
+			}
+		})
+	}
+}
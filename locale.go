@@ -0,0 +1,121 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/language"
+)
+
+// availableLanguages returns the tags of the loaded translations, English
+// first so it wins when nothing matches.
+func availableLanguages() []string {
+	translationsMu.RLock()
+	defer translationsMu.RUnlock()
+	tags := []string{}
+	for tag := range translations {
+		if tag != fallbackLanguage {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	return append([]string{fallbackLanguage}, tags...)
+}
+
+// languageName returns the name of the language in that language, as given
+// by the languageName key of its translation.
+func languageName(tag string) string {
+	translationsMu.RLock()
+	defer translationsMu.RUnlock()
+	if m, ok := translations[tag]["languageName"]; ok && m.Text != "" {
+		return m.Text
+	}
+	return tag
+}
+
+// systemLocales returns the languages the user asked for, most preferred
+// first. As in gettext, the LANGUAGE priority list like "zh_TW:zh:en" comes
+// before LC_ALL, LC_MESSAGES and LANG and is ignored for the C locale.
+func systemLocales() []string {
+	primary := ""
+	for _, name := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		if primary = os.Getenv(name); primary != "" {
+			break
+		}
+	}
+	locales := []string{}
+	if primary != "C" && primary != "POSIX" {
+		for _, locale := range strings.Split(os.Getenv("LANGUAGE"), ":") {
+			if locale != "" {
+				locales = append(locales, locale)
+			}
+		}
+	}
+	if primary != "" {
+		locales = append(locales, primary)
+	}
+	if len(locales) == 0 && runtime.GOOS == "darwin" {
+		locales = appleLanguages()
+	}
+	return locales
+}
+
+var appleLanguagePattern = regexp.MustCompile(`[A-Za-z]{2,3}(-[A-Za-z0-9]+)*`)
+
+// appleLanguages reads the preferred languages of macOS, apps started from
+// Finder get no LANG.
+func appleLanguages() []string {
+	output, err := exec.Command("defaults", "read", "-g", "AppleLanguages").Output()
+	if err != nil {
+		slog.Warn("Error reading AppleLanguages", "error", err)
+		return nil
+	}
+	return appleLanguagePattern.FindAllString(string(output), -1)
+}
+
+// localeTag converts a POSIX locale like zh_TW.UTF-8 or sr_RS@latin to a
+// BCP-47 tag.
+func localeTag(locale string) (language.Tag, bool) {
+	locale = strings.SplitN(locale, ".", 2)[0]
+	locale = strings.SplitN(locale, "@", 2)[0]
+	locale = strings.ReplaceAll(locale, "_", "-")
+	if locale == "" || locale == "C" || locale == "POSIX" {
+		return language.Und, false
+	}
+	tag, err := language.Parse(locale)
+	if err != nil {
+		slog.Debug("Ignoring locale", "locale", locale, "error", err)
+		return language.Und, false
+	}
+	return tag, true
+}
+
+// negotiateLanguage picks the best translation for the preferred locales,
+// in order of preference, and falls back to English. Scripts and regions are
+// taken into account so zh-Hant, zh-HK and zh_TW.UTF-8 all get zh-TW.
+func negotiateLanguage(preferred ...string) string {
+	available := availableLanguages()
+	supported := make([]language.Tag, 0, len(available))
+	for _, tag := range available {
+		supported = append(supported, language.Make(tag))
+	}
+	requested := []language.Tag{}
+	for _, locale := range preferred {
+		if tag, ok := localeTag(locale); ok {
+			requested = append(requested, tag)
+		}
+	}
+	if len(requested) == 0 {
+		return fallbackLanguage
+	}
+	_, index, confidence := language.NewMatcher(supported).Match(requested...)
+	if confidence == language.No {
+		return fallbackLanguage
+	}
+	return available[index]
+}
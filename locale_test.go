@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestNegotiateLanguage(t *testing.T) {
+	translationsMu.Lock()
+	saved := translations
+	translations = map[string]map[string]message{"en": {}, "ja": {}, "pt": {}, "zh": {}, "zh-TW": {}}
+	translationsMu.Unlock()
+	defer func() {
+		translationsMu.Lock()
+		translations = saved
+		translationsMu.Unlock()
+	}()
+
+	for _, test := range []struct {
+		preferred []string
+		want      string
+	}{
+		{[]string{"zh-Hant-TW"}, "zh-TW"},
+		{[]string{"zh-Hant"}, "zh-TW"},
+		{[]string{"zh-HK"}, "zh-TW"},
+		{[]string{"zh_TW.UTF-8"}, "zh-TW"},
+		{[]string{"zh-Hans-CN"}, "zh"},
+		{[]string{"zh_CN.UTF-8"}, "zh"},
+		{[]string{"pt-BR"}, "pt"},
+		{[]string{"pt_PT.UTF-8"}, "pt"},
+		{[]string{"ja_JP.UTF-8"}, "ja"},
+		{[]string{"de-DE"}, "en"},
+		{[]string{"de", "ja"}, "ja"},
+		{[]string{"C"}, "en"},
+		{[]string{"sr_RS@latin"}, "en"},
+		{nil, "en"},
+	} {
+		if got := negotiateLanguage(test.preferred...); got != test.want {
+			t.Errorf("negotiateLanguage(%q) = %q, want %q", test.preferred, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogcatOptions controls the logcat stream started after the app is launched.
+type LogcatOptions struct {
+	Enabled bool     `yaml:"enabled,omitempty"`
+	Tags    []string `yaml:"tags,omitempty"`
+	Level   string   `yaml:"level,omitempty"`
+}
+
+// logOutput and logAlert receive the lines meant for the user, the GUI
+// replaces them so the lines end up in the log area. The CLI writes them to
+// stderr like the tool output, stdout carries the report.
+var logOutput = func(text string) {
+	fmt.Fprintln(os.Stderr, text)
+}
+
+var logAlert = func(text string) {
+	if isTTY(os.Stderr) {
+		fmt.Fprintln(os.Stderr, "\x1b[1;31m"+text+"\x1b[0m")
+		return
+	}
+	fmt.Fprintln(os.Stderr, text)
+}
+
+// appPollInterval is how often the stream checks that the app still runs,
+// adb logcat --pid keeps running after the process is gone.
+const appPollInterval = 2 * time.Second
+
+// trust failures worth highlighting, they tell whether the patch worked
+var logcatAlertPatterns = []string{"SSLHandshakeException", "CertPathValidatorException"}
+
+var (
+	activeLogcat   *logcatStream
+	activeLogcatMu sync.Mutex
+)
+
+type logcatStream struct {
+	cmd  *exec.Cmd
+	done chan struct{}
+}
+
+// Stop kills the underlying adb process and waits for the reader to finish.
+func (s *logcatStream) Stop() {
+	if s.cmd.Process != nil {
+		s.cmd.Process.Kill()
+	}
+	<-s.done
+}
+
+// Done is closed once the stream has ended.
+func (s *logcatStream) Done() <-chan struct{} {
+	return s.done
+}
+
+// getAppPID waits until the package has a running process and returns its PID.
+func getAppPID(device, packageName string, timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		output, err := toolCommand("adb", "-s", device, "shell", "pidof", packageName).Output()
+		if err == nil {
+			if pids := strings.Fields(string(output)); len(pids) > 0 {
+				return pids[0], nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("no running process for %s", packageName)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// appRunning tells whether the process with the PID still belongs to the
+// package, pidof fails when the package has no process.
+func appRunning(device, packageName, pid string) bool {
+	output, err := toolCommand("adb", "-s", device, "shell", "pidof", packageName).Output()
+	if err != nil {
+		return false
+	}
+	return pidListed(string(output), pid)
+}
+
+func pidListed(output, pid string) bool {
+	for _, p := range strings.Fields(output) {
+		if p == pid {
+			return true
+		}
+	}
+	return false
+}
+
+// logcatLevels maps the priorities of logcat, as letters or full names, to
+// the letter used in filter specs.
+var logcatLevels = map[string]string{
+	"V": "V", "VERBOSE": "V",
+	"D": "D", "DEBUG": "D",
+	"I": "I", "INFO": "I",
+	"W": "W", "WARN": "W", "WARNING": "W",
+	"E": "E", "ERROR": "E",
+	"F": "F", "FATAL": "F",
+	"S": "S", "SILENT": "S",
+}
+
+// parseLogcatLevel returns the letter of a logcat priority, V when level is
+// empty.
+func parseLogcatLevel(level string) (string, error) {
+	if level == "" {
+		return "V", nil
+	}
+	letter, ok := logcatLevels[strings.ToUpper(strings.TrimSpace(level))]
+	if !ok {
+		return "", fmt.Errorf("invalid logcat level %q, expected one of V, D, I, W, E, F, S or their names", level)
+	}
+	return letter, nil
+}
+
+func logcatFilterSpecs(opts LogcatOptions) ([]string, error) {
+	level, err := parseLogcatLevel(opts.Level)
+	if err != nil {
+		return nil, err
+	}
+	tags := uniqueStrings(opts.Tags)
+	if len(tags) == 0 {
+		return []string{"*:" + level}, nil
+	}
+	specs := []string{}
+	for _, tag := range tags {
+		specs = append(specs, tag+":"+level)
+	}
+	return append(specs, "*:S"), nil
+}
+
+// startLogcat streams the logcat of the running app to logOutput, lines that
+// contain a trust failure go to logAlert instead. The stream ends when the
+// process of the app is gone.
+func startLogcat(device, packageName string, opts LogcatOptions) (*logcatStream, error) {
+	specs, err := logcatFilterSpecs(opts)
+	if err != nil {
+		return nil, err
+	}
+	pid, err := getAppPID(device, packageName, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	args := append([]string{"-s", device, "logcat", "--pid=" + pid, "-v", "brief"}, specs...)
+	cmd := toolCommand("adb", args...)
+	slog.Info("Running command", "args", redactArgs(cmd.Args))
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	s := &logcatStream{cmd: cmd, done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		scanner := bufio.NewScanner(stdout)
+		// 堆栈和 JSON 输出的行可能超过默认的 64KB
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if isLogcatAlert(line) {
+				logAlert(line)
+			} else {
+				logOutput(line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			slog.Warn("Error reading logcat", "error", err)
+			cmd.Process.Kill()
+		}
+		cmd.Wait()
+	}()
+	// 应用退出后结束日志流
+	go func() {
+		ticker := time.NewTicker(appPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+				if !appRunning(device, packageName, pid) {
+					slog.Info("App exited, stopping logcat", "package", packageName, "pid", pid)
+					cmd.Process.Kill()
+					return
+				}
+			}
+		}
+	}()
+	return s, nil
+}
+
+func isLogcatAlert(line string) bool {
+	for _, pattern := range logcatAlertPatterns {
+		if strings.Contains(line, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// followLogcat replaces the active stream with one for the given package.
+func followLogcat(device, packageName string, opts LogcatOptions) error {
+	stopLogcat()
+	s, err := startLogcat(device, packageName, opts)
+	if err != nil {
+		return err
+	}
+	activeLogcatMu.Lock()
+	activeLogcat = s
+	activeLogcatMu.Unlock()
+	return nil
+}
+
+func logcatActive() bool {
+	activeLogcatMu.Lock()
+	defer activeLogcatMu.Unlock()
+	return activeLogcat != nil
+}
+
+func stopLogcat() {
+	activeLogcatMu.Lock()
+	s := activeLogcat
+	activeLogcat = nil
+	activeLogcatMu.Unlock()
+	if s != nil {
+		s.Stop()
+	}
+}
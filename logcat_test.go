@@ -0,0 +1,63 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPIDListed(t *testing.T) {
+	for _, test := range []struct {
+		output string
+		pid    string
+		want   bool
+	}{
+		{"1234\n", "1234", true},
+		{"4321 1234\n", "1234", true},
+		{"12345\n", "1234", false},
+		{"", "1234", false},
+	} {
+		if got := pidListed(test.output, test.pid); got != test.want {
+			t.Errorf("pidListed(%q, %q) = %v, want %v", test.output, test.pid, got, test.want)
+		}
+	}
+}
+
+func TestLogcatFilterSpecs(t *testing.T) {
+	for _, test := range []struct {
+		opts LogcatOptions
+		want []string
+	}{
+		{LogcatOptions{}, []string{"*:V"}},
+		{LogcatOptions{Level: "w"}, []string{"*:W"}},
+		{LogcatOptions{Level: "Error"}, []string{"*:E"}},
+		{LogcatOptions{Level: "warning", Tags: []string{"OkHttp", "OkHttp"}}, []string{"OkHttp:W", "*:S"}},
+		{LogcatOptions{Level: "verbose-ish"}, nil},
+		{LogcatOptions{Level: "Error123"}, nil},
+		{LogcatOptions{Level: "X"}, nil},
+	} {
+		got, err := logcatFilterSpecs(test.opts)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("logcatFilterSpecs(%+v) = %q, want an error", test.opts, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("logcatFilterSpecs(%+v) = %q, %v, want %q", test.opts, got, err, test.want)
+		}
+	}
+}
+
+func TestConfigRefusesUnknownLogcatLevel(t *testing.T) {
+	for level, ok := range map[string]bool{"": true, "D": true, "fatal": true, "verbose-ish": false, "Error123": false} {
+		c := Config{Profiles: map[string]*Profile{"default": {Logcat: LogcatOptions{Level: level}}}}
+		err := c.validate()
+		if (err == nil) != ok {
+			t.Errorf("level %q: validate() = %v, want ok %v", level, err, ok)
+		}
+		if err != nil && !strings.Contains(err.Error(), "profiles.default.logcat.level") {
+			t.Errorf("level %q: error %q does not name the key", level, err)
+		}
+	}
+}
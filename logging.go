@@ -0,0 +1,326 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+const (
+	logFileName = "apicker.log"
+	// the log file is rotated once it would grow beyond maxLogSize, maxLogFiles
+	// rotated files are kept next to it
+	maxLogSize  = 5 << 20
+	maxLogFiles = 5
+)
+
+// logOptions are taken from the command line before the subcommand runs.
+type logOptions struct {
+	// Verbose also logs debug records and copies the records to stderr
+	Verbose bool
+	// Quiet only logs warnings and errors and hides the tool output
+	Quiet bool
+	// Format is "text" or "json"
+	Format string
+}
+
+var (
+	logOpts = logOptions{Format: "text"}
+	// logHandler writes the records, the default logger adds the run ID to it
+	logHandler slog.Handler
+	logFile    *rotatingFile
+	// activeLogDir is where the log file was opened, it differs from logDir
+	// when that could not be used
+	activeLogDir string
+	runID        string
+	runIDMu      sync.Mutex
+)
+
+// logDir returns the log directory, APICKER_LOG_DIR or the user state
+// directory: $XDG_STATE_HOME/apicker on Linux, ~/Library/Logs/apicker on
+// macOS and %LOCALAPPDATA%\apicker\logs on Windows.
+func logDir() string {
+	if dir := os.Getenv("APICKER_LOG_DIR"); dir != "" {
+		return dir
+	}
+	homeDir, _ := os.UserHomeDir()
+	switch runtime.GOOS {
+	case "darwin":
+		return filepath.Join(homeDir, "Library", "Logs", "apicker")
+	case "windows":
+		if dir := os.Getenv("LOCALAPPDATA"); dir != "" {
+			return filepath.Join(dir, "apicker", "logs")
+		}
+		return filepath.Join(homeDir, "AppData", "Local", "apicker", "logs")
+	}
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "apicker")
+	}
+	return filepath.Join(homeDir, ".local", "state", "apicker")
+}
+
+// logFilePath returns the path of the current log file.
+func logFilePath() string {
+	if activeLogDir != "" {
+		return filepath.Join(activeLogDir, logFileName)
+	}
+	return filepath.Join(logDir(), logFileName)
+}
+
+// extractLogFlags removes --verbose, --quiet and --log-format from the
+// arguments, like --profile they may be given anywhere on the command line.
+// APICKER_LOG_FORMAT sets the format when the flag is not given.
+func extractLogFlags(args []string) (logOptions, []string, error) {
+	opts := logOptions{Format: "text"}
+	if format := os.Getenv("APICKER_LOG_FORMAT"); format != "" {
+		opts.Format = format
+	}
+	rest := []string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			rest = append(rest, args[i:]...)
+			i = len(args)
+		case arg == "-verbose" || arg == "--verbose" || arg == "-v":
+			opts.Verbose = true
+		case arg == "-quiet" || arg == "--quiet" || arg == "-q":
+			opts.Quiet = true
+		case arg == "-log-format" || arg == "--log-format":
+			if i+1 >= len(args) {
+				return opts, nil, errors.New("flag needs an argument: -log-format")
+			}
+			opts.Format = args[i+1]
+			i++
+		case strings.HasPrefix(arg, "-log-format=") || strings.HasPrefix(arg, "--log-format="):
+			opts.Format = arg[strings.Index(arg, "=")+1:]
+		default:
+			rest = append(rest, arg)
+		}
+	}
+	if opts.Verbose && opts.Quiet {
+		return opts, nil, errors.New("-verbose and -quiet can not be used together")
+	}
+	if opts.Format != "text" && opts.Format != "json" {
+		return opts, nil, fmt.Errorf("unknown log format %q, use text or json", opts.Format)
+	}
+	return opts, rest, nil
+}
+
+// setupLogging makes slog write to the rotated log file, the records of the
+// log package end up there too. The log directory is created when missing,
+// when it can not be used the log file is moved to the temporary directory
+// and only when that fails too the records go to stderr.
+func setupLogging(opts logOptions) error {
+	logOpts = opts
+	level := slog.LevelInfo
+	switch {
+	case opts.Verbose:
+		level = slog.LevelDebug
+	case opts.Quiet:
+		level = slog.LevelWarn
+		// 安静模式下不显示外部工具的输出
+		toolOutput = func(stage, line string) {}
+	}
+
+	dirs := []string{logDir(), filepath.Join(os.TempDir(), "apicker-logs")}
+	failures := []string{}
+	for _, dir := range dirs {
+		f, err := openLogFile(dir)
+		if err != nil {
+			failures = append(failures, err.Error())
+			continue
+		}
+		logFile, activeLogDir = f, dir
+		var out io.Writer = f
+		if opts.Verbose {
+			out = io.MultiWriter(f, os.Stderr)
+		}
+		setupLogHandler(out, level)
+		if dir != dirs[0] {
+			slog.Warn("Log directory not usable, logging to the temporary directory", "dir", dirs[0], "error", failures[0], "log", logFilePath())
+			fmt.Fprintln(os.Stderr, "Logging to", logFilePath(), "because", failures[0])
+		}
+		return nil
+	}
+	setupLogHandler(os.Stderr, level)
+	return errors.New(strings.Join(failures, "; "))
+}
+
+// openLogFile creates dir when needed and opens the log file in it.
+func openLogFile(dir string) (*rotatingFile, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("creating log directory: %w", err)
+	}
+	return openRotatingFile(filepath.Join(dir, logFileName), maxLogSize, maxLogFiles)
+}
+
+// setupLogHandler installs the handler writing to out.
+func setupLogHandler(out io.Writer, level slog.Level) {
+	handlerOpts := &slog.HandlerOptions{Level: level}
+	if logOpts.Format == "json" {
+		logHandler = slog.NewJSONHandler(out, handlerOpts)
+	} else {
+		logHandler = slog.NewTextHandler(out, handlerOpts)
+	}
+	setRunID(newRunID())
+}
+
+func closeLogging() {
+	if logFile != nil {
+		logFile.Close()
+	}
+}
+
+// newRunID returns a short random ID that ties the log records of a run to
+// its report.
+func newRunID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "000000000000"
+	}
+	return hex.EncodeToString(b)
+}
+
+// setRunID adds id to every following record. Runs of the GUI each get their
+// own ID, a CLI invocation keeps one for all its inputs.
+func setRunID(id string) {
+	runIDMu.Lock()
+	runID = id
+	runIDMu.Unlock()
+	slog.SetDefault(slog.New(logHandler).With("run", id))
+}
+
+func currentRunID() string {
+	runIDMu.Lock()
+	defer runIDMu.Unlock()
+	return runID
+}
+
+// rotatingFile is an append-only log file that is renamed to .1, .2, ... once
+// it reaches its maximum size.
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	return f, f.open()
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, stat.Size()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			// 轮转失败时只能提示到标准错误
+			fmt.Fprintln(os.Stderr, "Error rotating log file:", err)
+		}
+		if f.file == nil {
+			return 0, os.ErrClosed
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate shifts apicker.log.N-1 to apicker.log.N, drops the oldest file and
+// starts a new apicker.log.
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	os.Remove(fmt.Sprintf("%s.%d", f.path, f.maxFiles))
+	for i := f.maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	renameErr := os.Rename(f.path, f.path+".1")
+	if err := f.open(); err != nil {
+		f.file = nil
+		return err
+	}
+	return renameErr
+}
+
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// logBuffer keeps the last lines of the GUI log. Lines are added from any
+// goroutine, the log area takes the text on its own schedule, so a burst of
+// tool output does not rebuild the text once per line.
+type logBuffer struct {
+	mu    sync.Mutex
+	lines []string
+	// start is the oldest line once the buffer is full
+	start int
+	max   int
+	dirty bool
+}
+
+func newLogBuffer(max int) *logBuffer {
+	return &logBuffer{lines: make([]string, 0, max), max: max}
+}
+
+func (b *logBuffer) add(line string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.lines) < b.max {
+		b.lines = append(b.lines, line)
+	} else {
+		b.lines[b.start] = line
+		b.start = (b.start + 1) % b.max
+	}
+	b.dirty = true
+}
+
+// flush returns the text when lines were added since the last flush.
+func (b *logBuffer) flush() (string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.dirty {
+		return "", false
+	}
+	b.dirty = false
+	ordered := append(append(make([]string, 0, len(b.lines)), b.lines[b.start:]...), b.lines[:b.start]...)
+	return strings.Join(ordered, "\n"), true
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestLogBufferKeepsLastLines(t *testing.T) {
+	for _, test := range []struct {
+		add  int
+		want string
+	}{
+		{0, ""},
+		{2, "1\n2"},
+		{3, "1\n2\n3"},
+		{5, "3\n4\n5"},
+		{7, "5\n6\n7"},
+	} {
+		b := newLogBuffer(3)
+		for i := 1; i <= test.add; i++ {
+			b.add(strconv.Itoa(i))
+		}
+		text, ok := b.flush()
+		if ok != (test.add > 0) || text != test.want {
+			t.Errorf("%d lines: flush() = %q, %v, want %q", test.add, text, ok, test.want)
+		}
+		if _, ok := b.flush(); ok {
+			t.Errorf("%d lines: second flush reported new lines", test.add)
+		}
+	}
+}
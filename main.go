@@ -2,30 +2,28 @@ package main
 
 import (
 	"bytes"
-	"encoding/xml"
-	"flag"
+	"context"
 	"fmt"
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/app"
 	"fyne.io/fyne/v2/container"
 	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/storage"
 	"fyne.io/fyne/v2/theme"
 	"fyne.io/fyne/v2/widget"
-	"github.com/flopp/go-findfont"
-	"gopkg.in/yaml.v3"
 	"image/color"
+	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
-	"runtime"
 	"strings"
+	"time"
 )
 
-var logFile *os.File
-var translations map[string]map[string]string
+var translations map[string]map[string]message
 var currentLang string
 var (
 	defaultKeyStore         = "keystore.jks"
@@ -36,277 +34,739 @@ var (
 )
 
 func main() {
-	// Open log file
-	var err error
-	logFile, err = os.OpenFile("logs/apicker.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	// --verbose、--quiet 和 --log-format 在子命令之前处理
+	logOptions, args, err := extractLogFlags(os.Args[1:])
 	if err != nil {
-		fmt.Println("Error opening log file:", err)
-		return
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(exitUsage)
 	}
-	defer logFile.Close()
-	log.SetFlags(log.LstdFlags | log.Llongfile)
-	// Set log output to file
-	log.SetOutput(logFile)
+	// Open log file, the records go to stderr when it can not be opened
+	if err := setupLogging(logOptions); err != nil {
+		fmt.Fprintln(os.Stderr, "Error opening log file:", err)
+	}
+	defer closeLogging()
 
 	// Load user config
 	err = loadConfig()
 	if err != nil {
-		log.Println("Error loading config:", err)
+		slog.Error("Error loading config", "error", err)
+		fmt.Fprintln(os.Stderr, "Error loading config:", err)
 	}
+	// 叠加项目配置和环境变量，APK 旁边的 apicker.yml 也会被读取
+	configInputs = inputArgs(args)
+	applyConfigLayers()
 
-	// Determine language
-	currentLang = config.Language
-	if currentLang == "" {
-		currentLang = getSystemLanguage()
-	}
-	fmt.Println(currentLang)
 	// Load translations
-	translations, err = loadLanguageFiles()
-	if err != nil {
-		log.Println("Error loading language files:", err)
-		translations, _ = loadLanguageFiles()
-	}
-
-	// if isTTY() {
-	// 	runCLI()
-	// } else {
-	runGUI()
-	// }
-}
-
-func runCLI() {
-	apkFile := flag.String("apk", "path/to/your.apk", translations[currentLang]["apkFilePath"])
-	domain := flag.String("domain", "", translations[currentLang]["domain"])
-	keystore := flag.String("keystore", defaultKeyStore, translations[currentLang]["keystorePath"])
-	keystorePassword := flag.String("keystorePassword", defaultKeyStorePassword, translations[currentLang]["keystorePassword"])
-	keyAlias := flag.String("keyAlias", defaultKeyAlias, translations[currentLang]["keyAlias"])
-	keyPassword := flag.String("keyPassword", defaultKeyPassword, translations[currentLang]["keyPassword"])
-	dname := flag.String("dname", defaultDName, translations[currentLang]["dname"])
-
-	flag.Parse()
-
-	missingDeps := checkDependencies()
-	if len(missingDeps) > 0 {
-		log.Println(translations[currentLang]["missingDependencies"])
-		for _, dep := range missingDeps {
-			log.Println("missing dep", dep)
-		}
-		return
+	if err = reloadTranslations(); err != nil {
+		slog.Error("Error loading language files", "error", err)
 	}
-
-	err := modifyAPK(*apkFile, *domain, *keystore, *keystorePassword, *keyAlias, *keyPassword, *dname)
-	if err != nil {
-		log.Println("Error modifying APK:", err)
+	// Determine language, the configured one first and then the system locales
+	currentLang = negotiateLanguage(append([]string{config.Language}, systemLocales()...)...)
+	slog.Info("Starting", "language", currentLang, "args", redactArgs(args))
+
+	// 没有参数时启动图形界面，否则按子命令执行
+	if len(args) > 0 {
+		code := runCLI(args)
+		closeLogging()
+		os.Exit(code)
 	}
+	runGUI()
 }
 
 func runGUI() {
-	// fontPaths := findfont.List()
-	// for _, path := range fontPaths {
-	// 	fmt.Println(path)
-	// 	// if strings.Contains(path, "FiraCode") {
-	// 	// 	os.Setenv("FYNE_FONT", path)
-	// 	// 	break
-	// 	// }
-	// }
 	myApp := app.New()
-	myApp.Settings().SetTheme(&myTheme{"AAA"})
-	fmt.Println(myApp.Settings().Theme())
-	// myApp.Settings().SetTheme(theme.LightTheme())
-	myWindow := myApp.NewWindow("汉字显示效果")
+	// 使用暗色主题，字体在创建主题时查找一次
+	myApp.Settings().SetTheme(newMyTheme(config.Font))
+	myWindow := myApp.NewWindow(T("windowTitle"))
 	myWindow.CenterOnScreen()
-	myWindow.Resize(fyne.NewSize(800, 600))
-	myWindow.SetTitle(translations[currentLang]["apkFilePath"])
-	// 使用暗色主题
-	myApp.Settings().SetTheme(theme.DarkTheme())
-	fmt.Println(currentLang, translations[currentLang]["apkFilePath"])
+	myWindow.Resize(fyne.NewSize(1200, 700))
+	// 界面上的文字都绑定到翻译键，切换语言后立即更新
+	texts := &textScope{}
+	texts.bind("windowTitle", myWindow.SetTitle)
 	// 文件路径选择器
-	apkPathLabel := widget.NewLabel(translations[currentLang]["apkFilePath"])
+	apkPathLabel := texts.label("apkFilePath")
 	apkPathEntry := widget.NewEntry()
-	apkPathEntry.SetPlaceHolder(translations[currentLang]["selectAPKFile"])
-	apkPathButton := widget.NewButton(translations[currentLang]["browse"], func() {
-		dialog.NewFileOpen(func(reader fyne.URIReadCloser, err error) {
+	texts.placeholder(apkPathEntry, "selectAPKFile")
+	apkPathButton := texts.button("browse", func() {
+		fileDialog := dialog.NewFileOpen(func(reader fyne.URIReadCloser, err error) {
 			if err == nil && reader != nil {
 				apkPathEntry.SetText(reader.URI().Path())
+				reader.Close()
 			}
-		}, myWindow).Show()
+		}, myWindow)
+		fileDialog.SetFilter(storage.NewExtensionFileFilter(inputExtensions))
+		fileDialog.Show()
+	})
+	// 拖放 APK 文件到窗口
+	myWindow.SetOnDropped(func(_ fyne.Position, uris []fyne.URI) {
+		for _, uri := range uris {
+			if isInputFile(uri.Path()) {
+				apkPathEntry.SetText(uri.Path())
+				return
+			}
+		}
+	})
+	// 从设备中拉取已安装的应用，拆分的 APK 会和 base.apk 一起处理
+	var pulledAPKs []string
+	var appendLog func(text string)
+	fromDeviceButton := texts.button("fromDevice", func() {
+		device, err := getConnectedDevice()
+		if err != nil || device == "" {
+			showTranslatedDialog(&textScope{}, func(func(bool)) dialog.Dialog {
+				return dialog.NewInformation(T("fromDevice"), T("noDevice"), myWindow)
+			}, nil)
+			return
+		}
+		packages, err := listThirdPartyPackages(device)
+		if err != nil {
+			appendLog(T("error", Args{"error": err}))
+			return
+		}
+		dialogTexts := &textScope{}
+		packageSelect := widget.NewSelect(packages, nil)
+		dialogTexts.selectPlaceholder(packageSelect, "selectPackage")
+		showTranslatedDialog(dialogTexts, func(callback func(bool)) dialog.Dialog {
+			return dialog.NewCustomConfirm(T("fromDevice"), T("pull"), T("close"), packageSelect, callback, myWindow)
+		}, func(confirmed bool) {
+			if !confirmed || packageSelect.Selected == "" {
+				return
+			}
+			packageName := packageSelect.Selected
+			go func() {
+				appendLog(T("pullingPackage") + " " + packageName)
+				apks, err := pullPackage(device, packageName, filepath.Join(pulledDir, packageName))
+				if err != nil {
+					appendLog(T("error", Args{"error": err}))
+					return
+				}
+				pulledAPKs = apks
+				apkPathEntry.SetText(apks[0])
+			}()
+		})
 	})
 
-	// 其他输入框
+	// 选择文件后在右侧显示 APK 的信息
+	inspector := newInspectorPanel(texts)
+
+	// 其他输入框，初始值来自当前的配置方案
+	initial := config.profile().patchOptions()
 	domainEntry := widget.NewEntry()
-	fmt.Println(translations[currentLang]["domain"])
-	domainEntry.SetPlaceHolder(translations[currentLang]["domain"])
+	texts.placeholder(domainEntry, "domain")
+	domainEntry.SetText(initial.Domain)
 
 	keystoreEntry := widget.NewEntry()
-	keystoreEntry.SetPlaceHolder(translations[currentLang]["keystorePath"])
-	keystoreEntry.SetText(defaultKeyStore)
+	texts.placeholder(keystoreEntry, "keystorePath")
+	keystoreEntry.SetText(initial.Keystore)
 
 	keystorePasswordEntry := widget.NewPasswordEntry()
-	keystorePasswordEntry.SetPlaceHolder(translations[currentLang]["keystorePassword"])
-	keystorePasswordEntry.SetText(defaultKeyStorePassword)
+	texts.placeholder(keystorePasswordEntry, "keystorePassword")
+	keystorePasswordEntry.SetText(initial.KeystorePassword)
 
 	keyAliasEntry := widget.NewEntry()
-	keyAliasEntry.SetPlaceHolder(translations[currentLang]["keyAlias"])
-	keyAliasEntry.SetText(defaultKeyAlias)
+	texts.placeholder(keyAliasEntry, "keyAlias")
+	keyAliasEntry.SetText(initial.KeyAlias)
 
 	keyPasswordEntry := widget.NewPasswordEntry()
-	keyPasswordEntry.SetPlaceHolder(translations[currentLang]["keyPassword"])
-	keyPasswordEntry.SetText(defaultKeyPassword)
+	texts.placeholder(keyPasswordEntry, "keyPassword")
+	keyPasswordEntry.SetText(initial.KeyPassword)
 	dnameEntry := widget.NewEntry()
-	dnameEntry.SetPlaceHolder(translations[currentLang]["dname"])
-	dnameEntry.SetText(defaultDName)
+	texts.placeholder(dnameEntry, "dname")
+	dnameEntry.SetText(initial.DName)
+
+	// 打包进 APK 的 CA 文件（用逗号分隔）和其他修改选项
+	caFilesEntry := widget.NewEntry()
+	texts.placeholder(caFilesEntry, "caFiles")
+	caFilesEntry.SetText(strings.Join(initial.CAFiles, ","))
+	caFilesButton := texts.button("browse", func() {
+		fileDialog := dialog.NewFileOpen(func(reader fyne.URIReadCloser, err error) {
+			if err != nil || reader == nil {
+				return
+			}
+			reader.Close()
+			files := append(uniqueStrings(strings.Split(caFilesEntry.Text, ",")), reader.URI().Path())
+			caFilesEntry.SetText(strings.Join(uniqueStrings(files), ","))
+		}, myWindow)
+		fileDialog.SetFilter(storage.NewExtensionFileFilter([]string{".pem", ".crt", ".cer", ".der"}))
+		fileDialog.Show()
+	})
+	skipUserCAsCheck := texts.check("skipUserCAs", nil)
+	skipUserCAsCheck.Checked = initial.Patch.SkipUserCAs
+	disableCleartextCheck := texts.check("disableCleartext", nil)
+	disableCleartextCheck.Checked = initial.Patch.DisableCleartext
+	debuggableCheck := texts.check("debuggable", nil)
+	debuggableCheck.Checked = initial.Patch.Debuggable
+
+	// formOptions returns the patch and signing options of the form
+	formOptions := func() patchOptions {
+		return patchOptions{
+			APKFile:          apkPathEntry.Text,
+			Domain:           domainEntry.Text,
+			Keystore:         keystoreEntry.Text,
+			KeystorePassword: keystorePasswordEntry.Text,
+			KeyAlias:         keyAliasEntry.Text,
+			KeyPassword:      keyPasswordEntry.Text,
+			DName:            dnameEntry.Text,
+			CAFiles:          uniqueStrings(strings.Split(caFilesEntry.Text, ",")),
+			Patch: PatchSettings{
+				SkipUserCAs:      skipUserCAsCheck.Checked,
+				DisableCleartext: disableCleartextCheck.Checked,
+				Debuggable:       debuggableCheck.Checked,
+			},
+		}
+	}
+
+	// 最近使用的文件，选择后填入上次的设置
+	recentLabels := func() []string {
+		labels := []string{}
+		for _, r := range config.Recent {
+			labels = append(labels, r.label())
+		}
+		return labels
+	}
+	recentSelect := widget.NewSelect(recentLabels(), func(selected string) {
+		for _, r := range config.Recent {
+			if r.label() != selected {
+				continue
+			}
+			apkPathEntry.SetText(r.Path)
+			pulledAPKs = append([]string{r.Path}, r.SplitAPKs...)
+			domainEntry.SetText(r.Domain)
+			if r.Keystore != "" {
+				keystoreEntry.SetText(r.Keystore)
+			}
+			if r.KeyAlias != "" {
+				keyAliasEntry.SetText(r.KeyAlias)
+			}
+			if r.DName != "" {
+				dnameEntry.SetText(r.DName)
+			}
+			return
+		}
+	})
+	texts.selectPlaceholder(recentSelect, "recentInputs")
+
+	// 安装后的权限和电池优化设置
+	grantDangerousCheck := texts.check("grantDangerous", func(checked bool) {
+		config.profile().PostInstall.GrantDangerous = checked
+		saveConfig()
+	})
+	grantDangerousCheck.Checked = config.profile().PostInstall.GrantDangerous
+	batteryCheck := texts.check("disableBatteryOptimization", func(checked bool) {
+		config.profile().PostInstall.DisableBatteryOptimization = checked
+		saveConfig()
+	})
+	batteryCheck.Checked = config.profile().PostInstall.DisableBatteryOptimization
+	// 安装后授予的权限和设置的 app-ops，都用逗号分隔
+	grantPermissionsEntry := widget.NewEntry()
+	texts.placeholder(grantPermissionsEntry, "grantPermissions")
+	grantPermissionsEntry.SetText(strings.Join(config.profile().PostInstall.GrantPermissions, ","))
+	appOpsEntry := widget.NewEntry()
+	texts.placeholder(appOpsEntry, "appOps")
+	appOpsEntry.SetText(formatAppOps(config.profile().PostInstall.AppOps))
+	appOpsEntry.Validator = func(text string) error {
+		_, err := parseAppOps(text)
+		return err
+	}
+	// 权限和 app-ops 在运行或另存方案时写入当前方案，不在每次输入时保存
+	formPostInstall := func() error {
+		ops, err := parseAppOps(appOpsEntry.Text)
+		if err != nil {
+			return err
+		}
+		config.profile().PostInstall.GrantPermissions = uniqueStrings(strings.Split(grantPermissionsEntry.Text, ","))
+		config.profile().PostInstall.AppOps = ops
+		return nil
+	}
+	logcatCheck := texts.check("streamLogcat", func(checked bool) {
+		config.profile().Logcat.Enabled = checked
+		saveConfig()
+	})
+	logcatCheck.Checked = config.profile().Logcat.Enabled
+	// 模拟器选择，第一个选项表示使用已连接的设备
+	avds, err := listAVDs()
+	if err != nil {
+		slog.Warn("Error listing AVDs", "error", err)
+	}
+	var avdSelect *widget.Select
+	avdSelect = widget.NewSelect(append([]string{T("connectedDevice")}, avds...), func(selected string) {
+		if selected == avdSelect.Options[0] {
+			selected = ""
+		}
+		config.profile().Emulator.AVD = selected
+		saveConfig()
+	})
+	avdSelect.Selected = avdSelect.Options[0]
+	if config.profile().Emulator.AVD != "" {
+		avdSelect.Selected = config.profile().Emulator.AVD
+	}
+	texts.bind("connectedDevice", func(text string) {
+		if avdSelect.Selected == avdSelect.Options[0] {
+			avdSelect.Selected = text
+		}
+		avdSelect.Options[0] = text
+		avdSelect.Refresh()
+	})
+
+	// 配置方案：切换时用方案中的设置填充表单，可以导入导出与团队共享
+	applyProfile := func() {
+		p := config.profile()
+		opts := p.patchOptions()
+		domainEntry.SetText(opts.Domain)
+		keystoreEntry.SetText(opts.Keystore)
+		keystorePasswordEntry.SetText(opts.KeystorePassword)
+		keyAliasEntry.SetText(opts.KeyAlias)
+		keyPasswordEntry.SetText(opts.KeyPassword)
+		dnameEntry.SetText(opts.DName)
+		caFilesEntry.SetText(strings.Join(opts.CAFiles, ","))
+		skipUserCAsCheck.SetChecked(opts.Patch.SkipUserCAs)
+		disableCleartextCheck.SetChecked(opts.Patch.DisableCleartext)
+		debuggableCheck.SetChecked(opts.Patch.Debuggable)
+		grantDangerousCheck.SetChecked(p.PostInstall.GrantDangerous)
+		batteryCheck.SetChecked(p.PostInstall.DisableBatteryOptimization)
+		grantPermissionsEntry.SetText(strings.Join(p.PostInstall.GrantPermissions, ","))
+		appOpsEntry.SetText(formatAppOps(p.PostInstall.AppOps))
+		logcatCheck.SetChecked(p.Logcat.Enabled)
+		if p.Emulator.AVD != "" {
+			avdSelect.SetSelected(p.Emulator.AVD)
+		} else {
+			avdSelect.SetSelected(avdSelect.Options[0])
+		}
+	}
+	// 选择文件后读取 APK 旁边的项目配置
+	apkPathEntry.OnChanged = func(path string) {
+		inspector.inspect(path)
+		if stat, err := os.Stat(path); err == nil && !stat.IsDir() && setConfigInputs(path) {
+			applyProfile()
+		}
+	}
+	var profileSelect *widget.Select
+	profileSelect = widget.NewSelect(config.profileNames(), func(selected string) {
+		if selected == config.ActiveProfile {
+			return
+		}
+		if err := config.useProfile(selected); err != nil {
+			slog.Error("Error selecting profile", "error", err)
+			return
+		}
+		saveConfig()
+		applyProfile()
+	})
+	profileSelect.Selected = config.ActiveProfile
+	texts.selectPlaceholder(profileSelect, "profile")
+	refreshProfiles := func() {
+		profileSelect.Options = config.profileNames()
+		profileSelect.Selected = config.ActiveProfile
+		profileSelect.Refresh()
+	}
+	saveProfileButton := texts.button("saveProfileAs", func() {
+		nameEntry := widget.NewEntry()
+		nameEntry.SetText(config.ActiveProfile)
+		showTranslatedDialog(&textScope{}, func(callback func(bool)) dialog.Dialog {
+			return dialog.NewForm(T("saveProfileAs"), T("save"), T("close"), []*widget.FormItem{
+				widget.NewFormItem(T("profileName"), nameEntry),
+			}, callback, myWindow)
+		}, func(confirmed bool) {
+			name := strings.TrimSpace(nameEntry.Text)
+			if !confirmed || name == "" {
+				return
+			}
+			// 新方案以当前方案的设备设置为基础
+			if _, ok := config.Profiles[name]; !ok {
+				p := *config.profile()
+				config.Profiles[name] = &p
+			}
+			config.useProfile(name)
+			config.profile().setPatchOptions(formOptions())
+			if err := formPostInstall(); err != nil {
+				appendLog(T("error", Args{"error": err}))
+				return
+			}
+			if err := saveConfig(); err != nil {
+				appendLog(T("error", Args{"error": err}))
+			}
+			refreshProfiles()
+		})
+	})
+	importProfileButton := texts.button("importProfile", func() {
+		dialog.ShowFileOpen(func(reader fyne.URIReadCloser, err error) {
+			if err != nil || reader == nil {
+				return
+			}
+			reader.Close()
+			name, err := importProfile(reader.URI().Path(), "")
+			if err != nil {
+				appendLog(T("error", Args{"error": err}))
+				return
+			}
+			config.useProfile(name)
+			saveConfig()
+			refreshProfiles()
+			applyProfile()
+		}, myWindow)
+	})
+	exportProfileButton := texts.button("exportProfile", func() {
+		saveDialog := dialog.NewFileSave(func(writer fyne.URIWriteCloser, err error) {
+			if err != nil || writer == nil {
+				return
+			}
+			writer.Close()
+			if err := exportProfile(config.ActiveProfile, writer.URI().Path()); err != nil {
+				appendLog(T("error", Args{"error": err}))
+			}
+		}, myWindow)
+		saveDialog.SetFileName(config.ActiveProfile + ".yml")
+		saveDialog.Show()
+	})
 
 	// 日志区域
 	logArea := widget.NewMultiLineEntry()
-	logArea.SetPlaceHolder(translations[currentLang]["logOutput"])
+	texts.placeholder(logArea, "logOutput")
 	logArea.Disable() // 禁用用户输入，使其成为只读
 
-	// 限制日志区域的文本不超过2000行
+	// 日志区域只保留最后2000行，后台的输出先放进缓冲，定时刷新到界面
 	const maxLines = 2000
-	appendLog := func(text string) {
-		logLines := strings.Split(logArea.Text, "\n")
-		logLines = append(logLines, text)
-		if len(logLines) > maxLines {
-			logLines = logLines[len(logLines)-maxLines:]
+	logLines := newLogBuffer(maxLines)
+	appendLog = logLines.add
+	logTicker := time.NewTicker(100 * time.Millisecond)
+	go func() {
+		for range logTicker.C {
+			if text, ok := logLines.flush(); ok {
+				logArea.SetText(text)
+			}
 		}
-		logArea.SetText(strings.Join(logLines, "\n"))
+	}()
+	logOutput = appendLog
+	logAlert = func(text string) {
+		appendLog("!!! " + text)
 	}
+	toolOutput = func(stage, line string) {
+		appendLog("[" + stage + "] " + line)
+	}
+	var cancelRun context.CancelFunc
+	myWindow.SetOnClosed(func() {
+		logTicker.Stop()
+		if cancelRun != nil {
+			cancelRun()
+		}
+		stopLogcat()
+		if !config.profile().Emulator.KeepRunning {
+			shutdownStartedEmulators()
+		}
+	})
+
+	// 进度条和取消按钮，修改在后台运行，界面不会卡住
+	progressBar := widget.NewProgressBar()
+	stageLabel := widget.NewLabel("")
+	stageText := texts.keyed(stageLabel.SetText)
+	cancelButton := texts.button("cancel", func() {
+		if cancelRun != nil {
+			cancelRun()
+		}
+	})
+	cancelButton.Disable()
+
+	// 最近一次运行的报告，诊断包默认使用它
+	var lastReportPath string
+
+	// 检查外部工具，要运行各个工具所以放到后台
+	var checkTools func()
+	// 下载固定版本的工具到缓存，设置了 APICKER_TOOLS_BUNDLE 时从离线包复制，完成后再检查一遍
+	downloadTools := func(pins []string) {
+		go func() {
+			if err := fetchTools(context.Background(), pins, os.Getenv("APICKER_TOOLS_BUNDLE"), appendLog); err != nil {
+				appendLog(T("error", Args{"error": err}))
+				return
+			}
+			checkTools()
+		}()
+	}
+	checkTools = func() {
+		appendLog(T("checkingTools"))
+		go func() {
+			showDoctorDialog(myWindow, runDoctor(context.Background()), downloadTools)
+		}()
+	}
+	toolsButton := texts.button("checkTools", checkTools)
 
 	// 按钮点击事件
-	button := widget.NewButton(translations[currentLang]["modifyAPK"], func() {
-		apkFile := apkPathEntry.Text
-		domain := domainEntry.Text
-		keystore := keystoreEntry.Text
-		keystorePassword := keystorePasswordEntry.Text
-		keyAlias := keyAliasEntry.Text
-		keyPassword := keyPasswordEntry.Text
-		dname := dnameEntry.Text
-		missing := checkDependencies()
-		if len(missing) > 0 {
-			aertDialog := dialog.NewCustom(translations[currentLang]["about"], translations[currentLang]["close"], container.NewVBox(
-				widget.NewLabel(translations[currentLang]["author"]),
-				widget.NewRichTextFromMarkdown(`
-### you are missing dependencies
-`+strings.Join(missing, " ")),
-			), myWindow)
-			aertDialog.Show()
-		}
-		appendLog(translations[currentLang]["apkModificationStarted"])
-		// 调用 modifyAPK 函数
-		err := modifyAPK(apkFile, domain, keystore, keystorePassword, keyAlias, keyPassword, dname)
+	var button *widget.Button
+	button = texts.button("modifyAPK", func() {
+		opts := formOptions()
+		if len(pulledAPKs) > 0 && pulledAPKs[0] == opts.APKFile {
+			opts.SplitAPKs = pulledAPKs[1:]
+		}
+		// 表单的设置保存到当前方案
+		config.profile().setPatchOptions(opts)
+		if err := formPostInstall(); err != nil {
+			appendLog(T("error", Args{"error": err}))
+			return
+		}
+		if err := saveConfig(); err != nil {
+			slog.Error("Error saving config", "error", err)
+		}
+		// 缺少必需的工具时不运行，打开工具检查说明怎么安装
+		if missing := missingTools(patchTools(opts)); len(missing) > 0 {
+			appendLog(T("error", Args{"error": missingToolsError(missing)}))
+			checkTools()
+			return
+		}
+		opts.OnStage = func(stage string) {
+			progressBar.SetValue(stageProgress(stage))
+			stageText.SetKey("stage_" + stage)
+		}
+		// 每次运行使用新的运行 ID，日志和报告可以对应起来
+		setRunID(newRunID())
+		appendLog(T("apkModificationStarted"))
+		button.Disable()
+		cancelButton.Enable()
+		progressBar.SetValue(0)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancelRun = cancel
+		go func() {
+			defer cancel()
+			// 调用 modifyAPK 函数
+			report, err := modifyAPK(ctx, opts)
+			switch {
+			case ctx.Err() != nil:
+				appendLog(T("apkModificationCancelled"))
+			case err != nil:
+				appendLog(T("error", Args{"error": err}))
+			default:
+				progressBar.SetValue(1)
+				appendLog(T("apkModificationCompleted"))
+			}
+			if report.ReportPath != "" {
+				appendLog(T("reportSaved") + " " + report.ReportPath)
+				lastReportPath = report.ReportPath
+			}
+			if err := addRecentInput(opts, report.Package); err != nil {
+				slog.Error("Error saving recent input", "error", err)
+			}
+			recentSelect.Options = recentLabels()
+			recentSelect.Refresh()
+			stageText.SetKey("")
+			cancelButton.Disable()
+			button.Enable()
+		}()
+	})
+
+	// 使用所选的最近设置再次运行
+	rerunButton := texts.button("rerun", func() {
+		if recentSelect.Selected == "" || button.Disabled() {
+			return
+		}
+		button.OnTapped()
+	})
+
+	// 保存诊断包，发给同事排查失败的运行
+	diagButton := texts.button("saveDiagnostics", func() {
+		reportPath := lastReportPath
+		if reportPath == "" {
+			var err error
+			if reportPath, err = findReport(""); err != nil {
+				appendLog(T("error", Args{"error": err}))
+				return
+			}
+		}
+		report, err := readReport(reportPath)
 		if err != nil {
-			appendLog(fmt.Sprintf(translations[currentLang]["error"], err))
-		} else {
-			appendLog(translations[currentLang]["apkModificationCompleted"])
+			appendLog(T("error", Args{"error": err}))
+			return
 		}
+		saveDialog := dialog.NewFileSave(func(writer fyne.URIWriteCloser, err error) {
+			if err != nil || writer == nil {
+				return
+			}
+			writer.Close()
+			go func() {
+				if err := writeDiagnostics(context.Background(), reportPath, writer.URI().Path()); err != nil {
+					appendLog(T("error", Args{"error": err}))
+					return
+				}
+				appendLog(T("diagnosticsSaved", Args{"path": writer.URI().Path()}))
+			}()
+		}, myWindow)
+		saveDialog.SetFileName(defaultDiagPath(report))
+		saveDialog.Show()
 	})
 
 	// 关于按钮
-	aboutButton := widget.NewButton(translations[currentLang]["about"], func() {
-		aboutDialog := dialog.NewCustom(translations[currentLang]["about"], translations[currentLang]["close"], container.NewVBox(
-			widget.NewLabel(translations[currentLang]["author"]),
-			widget.NewLabel(translations[currentLang]["donate"]),
-			widget.NewLabel(translations[currentLang]["alipay"]),
-			widget.NewLabel(translations[currentLang]["wechat"]),
-		), myWindow)
-		aboutDialog.Show()
+	aboutButton := texts.button("about", func() {
+		dialogTexts := &textScope{}
+		content := container.NewVBox(
+			dialogTexts.label("author"),
+			dialogTexts.label("donate"),
+			dialogTexts.label("alipay"),
+			dialogTexts.label("wechat"),
+		)
+		showTranslatedDialog(dialogTexts, func(func(bool)) dialog.Dialog {
+			return dialog.NewCustom(T("about"), T("close"), content, myWindow)
+		}, nil)
 	})
 	var languageSelect *widget.Select
-	// 语言选择下拉菜单
-	languageSelect = widget.NewSelect([]string{"English", "简体中文", "繁體中文", "日本語", "한국어"}, func(selected string) {
-		switch selected {
-		case "English":
-			currentLang = "en"
-		case "简体中文":
-			currentLang = "zh"
-		case "繁體中文":
-			currentLang = "zh-TW"
-		case "日本語":
-			currentLang = "ja"
-		case "한국어":
-			currentLang = "ko"
+	// 语言选择下拉菜单，列出所有找到的翻译，包括用户的翻译包
+	languageTags := make(map[string]string)
+	languageNames := func() []string {
+		names := []string{}
+		for _, tag := range availableLanguages() {
+			names = append(names, languageName(tag))
+			languageTags[languageName(tag)] = tag
 		}
+		return names
+	}
+	// 切换语言或重新加载翻译后刷新界面上的文字和打开的对话框
+	languageSelect = widget.NewSelect(languageNames(), func(selected string) {
+		tag, ok := languageTags[selected]
+		if !ok || tag == currentLang {
+			return
+		}
+		currentLang = tag
 		config.Language = currentLang
 		saveConfig()
-		updateUI(apkPathLabel, apkPathEntry, apkPathButton, domainEntry, keystoreEntry, keystorePasswordEntry, keyAliasEntry, keyPasswordEntry, dnameEntry, logArea, button, aboutButton, languageSelect)
+		refreshUITexts()
+	})
+	// 翻译包修改后立即生效，方便翻译时查看效果
+	watchTranslationPacks(time.Second, func() {
+		languageSelect.Options = languageNames()
+		languageSelect.Selected = languageName(currentLang)
+		refreshUITexts()
 	})
 
+	languageSelect.Selected = languageName(currentLang)
+	texts.selectPlaceholder(languageSelect, "selectLanguage")
+
 	// 布局
 	content := container.NewVBox(
-		widget.NewLabel("师姐值大雾"),
+		container.NewBorder(nil, nil, nil, container.NewHBox(saveProfileButton, importProfileButton, exportProfileButton), profileSelect),
 		apkPathLabel,
-		container.NewHBox(apkPathEntry, apkPathButton),
-		widget.NewLabel(translations[currentLang]["domain"]),
+		container.NewHBox(apkPathEntry, apkPathButton, fromDeviceButton),
+		container.NewBorder(nil, nil, nil, rerunButton, recentSelect),
+		texts.label("domain"),
 		domainEntry,
-		widget.NewLabel(translations[currentLang]["keystorePath"]),
+		texts.label("keystorePath"),
 		keystoreEntry,
-		widget.NewLabel(translations[currentLang]["keystorePassword"]),
+		texts.label("keystorePassword"),
 		keystorePasswordEntry,
-		widget.NewLabel(translations[currentLang]["keyAlias"]),
+		texts.label("keyAlias"),
 		keyAliasEntry,
-		widget.NewLabel(translations[currentLang]["keyPassword"]),
+		texts.label("keyPassword"),
 		keyPasswordEntry,
-		widget.NewLabel(translations[currentLang]["dname"]),
+		texts.label("dname"),
 		dnameEntry,
-		widget.NewLabel(translations[currentLang]["logOutput"]),
+		texts.label("caFiles"),
+		container.NewBorder(nil, nil, nil, caFilesButton, caFilesEntry),
+		container.NewHBox(skipUserCAsCheck, disableCleartextCheck, debuggableCheck),
+		container.NewHBox(avdSelect, grantDangerousCheck, batteryCheck, logcatCheck),
+		texts.label("grantPermissions"),
+		grantPermissionsEntry,
+		texts.label("appOps"),
+		appOpsEntry,
+		texts.label("logOutput"),
 		logArea,
-		container.NewHBox(button, aboutButton, languageSelect),
+		container.NewBorder(nil, nil, nil, stageLabel, progressBar),
+		container.NewHBox(button, cancelButton, toolsButton, diagButton, aboutButton, languageSelect),
 	)
 
-	myWindow.SetContent(content)
+	split := container.NewHSplit(content, inspector.content)
+	split.Offset = 0.65
+	myWindow.SetContent(split)
+	// 配置文件有问题时使用默认设置，并且不会覆盖该文件
+	if configLoadError != nil {
+		dialog.ShowError(configLoadError, myWindow)
+	}
 	myWindow.ShowAndRun()
 }
 
-func updateUI(apkPathLabel *widget.Label, apkPathEntry *widget.Entry, apkPathButton *widget.Button, domainEntry, keystoreEntry, keystorePasswordEntry, keyAliasEntry, keyPasswordEntry, dnameEntry, logArea *widget.Entry, button, aboutButton *widget.Button, languageSelect *widget.Select) {
-	apkPathLabel.SetText(translations[currentLang]["apkFilePath"])
-	apkPathEntry.SetPlaceHolder(translations[currentLang]["selectAPKFile"])
-	apkPathButton.SetText(translations[currentLang]["browse"])
-	domainEntry.SetPlaceHolder(translations[currentLang]["domain"])
-	keystoreEntry.SetPlaceHolder(translations[currentLang]["keystorePath"])
-	keystorePasswordEntry.SetPlaceHolder(translations[currentLang]["keystorePassword"])
-	keyAliasEntry.SetPlaceHolder(translations[currentLang]["keyAlias"])
-	keyPasswordEntry.SetPlaceHolder(translations[currentLang]["keyPassword"])
-	dnameEntry.SetPlaceHolder(translations[currentLang]["dname"])
-	logArea.SetPlaceHolder(translations[currentLang]["logOutput"])
-	button.SetText(translations[currentLang]["modifyAPK"])
-	aboutButton.SetText(translations[currentLang]["about"])
-	languageSelect.PlaceHolder = translations[currentLang]["selectLanguage"]
+// patchOptions holds the inputs of a single modifyAPK run.
+type patchOptions struct {
+	APKFile          string
+	SplitAPKs        []string
+	Domain           string
+	Keystore         string
+	KeystorePassword string
+	KeyAlias         string
+	KeyPassword      string
+	DName            string
+	// CAFiles are bundled into the APK and trusted in addition to the system CAs
+	CAFiles []string
+	Patch   PatchSettings
+	// WorkDir is where the APK is decoded, "output" when empty
+	WorkDir string
+	// OutputDir receives the signed APKs and the report, the working directory
+	// when empty
+	OutputDir string
+	// SkipInstall stops the run once the APK is signed
+	SkipInstall bool
+	// OnStage is called when the run enters a new stage
+	OnStage func(stage string)
 }
 
-func modifyAPK(apkFile, domain, keystore, keystorePassword, keyAlias, keyPassword, dname string) error {
-	outputDir := "output"
+// modifyAPK runs the whole pipeline and returns its report, which is also
+// saved next to the output.
+func modifyAPK(ctx context.Context, opts patchOptions) (report *runReport, err error) {
+	report = newRunReport(opts.APKFile)
+	report.SplitAPKs = opts.SplitAPKs
+	report.onStage = opts.OnStage
+	report.dir = opts.OutputDir
+	if opts.OutputDir != "" {
+		if err := os.MkdirAll(opts.OutputDir, 0755); err != nil {
+			return report, err
+		}
+	}
+	defer func() {
+		report.finish(err)
+		if saveErr := report.save(); saveErr != nil {
+			slog.Error("Error saving report", "error", saveErr)
+		}
+	}()
+	outputDir := opts.WorkDir
+	if outputDir == "" {
+		outputDir = "output"
+	}
 	os.RemoveAll(outputDir)
+	if report.WorkDir, err = filepath.Abs(outputDir); err != nil {
+		report.WorkDir = outputDir
+	}
 
 	// Step 1: Decode APK
-	log.Println("Decoding APK...")
-	decompileCmd := exec.Command("apktool", "d", apkFile, "-o", outputDir)
-	fmt.Println(decompileCmd.Args)
-	decompileCmd.Stdout = os.Stdout
-	decompileCmd.Stderr = os.Stderr
-	if err := decompileCmd.Run(); err != nil {
-		log.Println("Error decoding APK:", err)
-		return err
+	slog.Info("Decoding APK", "input", opts.APKFile)
+	report.startStage(stageDecode)
+	if isBundleFile(opts.APKFile) {
+		name := strings.TrimSuffix(filepath.Base(opts.APKFile), filepath.Ext(opts.APKFile))
+		apks, err := extractBundle(opts.APKFile, filepath.Join(opts.OutputDir, bundlesDir, name))
+		if err != nil {
+			slog.Error("Error extracting bundle", "error", err)
+			return report, stageFailed(stageDecode, err)
+		}
+		opts.APKFile = apks[0]
+		opts.SplitAPKs = append(apks[1:], opts.SplitAPKs...)
+		report.SplitAPKs = opts.SplitAPKs
+	}
+	// 拆分 APK 只能用 apksigner 重新签名，在解码之前检查，免得重新打包之后才失败
+	if len(opts.SplitAPKs) > 0 {
+		if missing := missingTools(splitSigningTools); len(missing) > 0 {
+			return report, stageFailed(stageSign, missingToolsError(missing))
+		}
+	}
+	if err := decodeAPK(ctx, opts.APKFile, outputDir); err != nil {
+		slog.Error("Error decoding APK", "error", err)
+		return report, stageFailed(stageDecode, err)
 	}
-	// return nil
 
 	// Step 2: Modify AndroidManifest.xml
-	manifestPath := outputDir + "/AndroidManifest.xml"
-	log.Println("Modifying AndroidManifest.xml...")
-	manifestContentBytes, err := ioutil.ReadFile(manifestPath)
+	slog.Info("Modifying AndroidManifest.xml")
+	info, err := readAPKInfo(outputDir)
 	if err != nil {
-		log.Println("Error reading AndroidManifest.xml:", err)
-		return err
+		slog.Error("Error reading AndroidManifest.xml", "error", err)
+		return report, stageFailed(stageDecode, err)
 	}
-
-	// 解析 XML 文件
-	var m manifest
-	err = xml.NewDecoder(bytes.NewBuffer(manifestContentBytes)).Decode(&m)
+	report.setAPKInfo(info)
+	m, manifestContentBytes, err := readManifest(outputDir)
 	if err != nil {
-		return fmt.Errorf("无法解析 AndroidManifest.xml: %v", err)
+		return report, stageFailed(stageDecode, err)
 	}
-	modifiedApk := fmt.Sprintf("%s_modified.apk", m.Package)
-
-	// 删除解压后的文件夹
+	report.startStage(stagePatch)
+	modifiedApk := filepath.Join(opts.OutputDir, fmt.Sprintf("%s_modified.apk", m.Package))
 
 	oldAttrPattern := regexp.MustCompile(`android:networkSecurityConfig="@xml/[^"]+"`)
 
@@ -316,309 +776,308 @@ func modifyAPK(apkFile, domain, keystore, keystorePassword, keyAlias, keyPasswor
 	// 查找并替换属性值
 	if oldAttrPattern.MatchString(manifestContent) {
 		manifestContent = oldAttrPattern.ReplaceAllString(manifestContent, newConfig)
+		report.Patches = append(report.Patches, "AndroidManifest.xml: networkSecurityConfig replaced")
 	} else {
 		// 如果属性不存在，则在 <application> 标签中添加
 		reApp := regexp.MustCompile(`<application[^>]*>`)
 		manifestContent = reApp.ReplaceAllString(manifestContent, `${0} `+newConfig)
+		report.Patches = append(report.Patches, "AndroidManifest.xml: networkSecurityConfig added")
+	}
+
+	if opts.Patch.Debuggable {
+		reDebuggable := regexp.MustCompile(`\s*android:debuggable="[^"]*"`)
+		manifestContent = reDebuggable.ReplaceAllString(manifestContent, "")
+		manifestContent = strings.Replace(manifestContent, "<application", `<application android:debuggable="true"`, 1)
+		report.Patches = append(report.Patches, "AndroidManifest.xml: debuggable set")
 	}
 
+	manifestPath := filepath.Join(outputDir, "AndroidManifest.xml")
 	if err := ioutil.WriteFile(manifestPath, []byte(manifestContent), 0644); err != nil {
-		log.Println("Error writing modified AndroidManifest.xml:", err)
-		return err
+		slog.Error("Error writing modified AndroidManifest.xml", "error", err)
+		return report, stageFailed(stagePatch, err)
 	}
 
 	// Step 3: Add network_security_config.xml
-	log.Println("Adding network_security_config.xml...")
-	var networkSecurityConfig string
-	if domain != "" {
-		networkSecurityConfig = fmt.Sprintf(`<?xml version="1.0" encoding="utf-8"?>
-<network-security-config>
-    <domain-config cleartextTrafficPermitted="true">
-        <domain includeSubdomains="true">%s</domain>
-        <trust-anchors>
-            <certificates src="system" />
-            <certificates src="user" />
-        </trust-anchors>
-    </domain-config>
-</network-security-config>`, domain)
-	} else {
-		networkSecurityConfig = `<?xml version="1.0" encoding="utf-8"?>
-<network-security-config>
-    <base-config cleartextTrafficPermitted="true">
-        <trust-anchors>
-            <certificates src="system" />
-            <certificates src="user" />
-        </trust-anchors>
-    </base-config>
-</network-security-config>`
+	slog.Info("Adding network_security_config.xml")
+	// 配置中的 CA 文件放到 res/raw 下，在 trust-anchors 中引用
+	caResources, err := copyCAFiles(outputDir, opts.CAFiles)
+	if err != nil {
+		slog.Error("Error copying CA files", "error", err)
+		return report, stageFailed(stagePatch, err)
 	}
+	domains := splitDomains(opts.Domain)
+	networkSecurityConfig := buildNetworkSecurityConfig(domains, caResources, opts.Patch)
 
 	resDir := outputDir + "/res/xml"
 	if err := os.MkdirAll(resDir, 0755); err != nil {
-		log.Println("Error creating res/xml directory:", err)
-		return err
+		slog.Error("Error creating res/xml directory", "error", err)
+		return report, stageFailed(stagePatch, err)
 	}
 
 	networkSecurityConfigPath := resDir + "/network_security_config.xml"
 	if err := ioutil.WriteFile(networkSecurityConfigPath, []byte(networkSecurityConfig), 0644); err != nil {
-		log.Println("Error writing network_security_config.xml:", err)
-		return err
+		slog.Error("Error writing network_security_config.xml", "error", err)
+		return report, stageFailed(stagePatch, err)
+	}
+	trusted := "system CAs"
+	if !opts.Patch.SkipUserCAs {
+		trusted += ", user CAs"
+	}
+	for _, ca := range caResources {
+		trusted += ", @raw/" + ca
+	}
+	if len(domains) > 0 {
+		report.Patches = append(report.Patches, "res/xml/network_security_config.xml: "+trusted+" trusted for "+strings.Join(domains, ", "))
+	} else {
+		report.Patches = append(report.Patches, "res/xml/network_security_config.xml: "+trusted+" trusted")
 	}
 
 	// Step 4: Rebuild APK
-	log.Println("Rebuilding APK...")
-	cmd := exec.Command("apktool", "b", outputDir, "-o", modifiedApk)
-	fmt.Println(cmd.Args)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		log.Println("Error rebuilding APK:", err)
-		return err
+	slog.Info("Rebuilding APK")
+	report.startStage(stageBuild)
+	cmd := toolCommandContext(ctx, "apktool", "b", outputDir, "-o", modifiedApk)
+	if err := runLogged(cmd, stageBuild); err != nil {
+		slog.Error("Error rebuilding APK", "error", err)
+		return report, stageFailed(stageBuild, err)
 	}
 
 	// Step 5: Check if keystore exists, if not generate a new one
-	if _, err := os.Stat(keystore); os.IsNotExist(err) {
-		log.Println("Keystore not found, generating a new one...")
-		keytoolCmd := exec.Command("keytool", "-genkeypair", "-v", "-storetype", "JKS", "-keystore", keystore, "-storepass", keystorePassword, "-keypass", keyPassword, "-alias", keyAlias, "-keyalg", "RSA", "-keysize", "2048", "-validity", "10000", "-dname", dname)
-		log.Println(keytoolCmd.Args)
-		keytoolCmd.Stdout = os.Stdout
-		keytoolCmd.Stderr = os.Stderr
-		if err := keytoolCmd.Run(); err != nil {
-			log.Println("Error generating keystore:", err)
-			return err
-		}
+	report.startStage(stageSign)
+	if err := ensureKeystore(ctx, opts); err != nil {
+		return report, stageFailed(stageSign, err)
 	}
-	{
-		checkKeyCmd := exec.Command("keytool", "-list", "-v", "-keystore", keystore, "-storepass", keystorePassword)
-		log.Println(checkKeyCmd.Args)
-		checkKeyCmd.Stdout = os.Stdout
-		checkKeyCmd.Stderr = os.Stderr
-		if err := checkKeyCmd.Run(); err != nil {
-			log.Println("checkKeyCmd error:", err)
-			return err
+	signedModifedApk := filepath.Join(opts.OutputDir, "signed_"+filepath.Base(modifiedApk))
+	// Step 6: Sign the APK
+	slog.Info("Signing APK")
+	signBase := signAPK
+	if len(opts.SplitAPKs) > 0 {
+		// 所有拆分 APK 都用 apksigner 以同一个密钥签名（v1 和 v2）
+		signBase = signAPKWithApksigner
+	}
+	if err := signBase(ctx, opts, modifiedApk, signedModifedApk); err != nil {
+		slog.Error("Error signing APK", "error", err)
+		return report, stageFailed(stageSign, err)
+	}
+	// split APKs must be signed with the same key as the base APK
+	signedSplits := []string{}
+	for _, split := range opts.SplitAPKs {
+		signedSplit := filepath.Join(filepath.Dir(split), "signed_"+filepath.Base(split))
+		if err := signSplitAPK(ctx, opts, split, signedSplit); err != nil {
+			slog.Error("Error signing split APK", "error", err)
+			return report, stageFailed(stageSign, err)
 		}
+		signedSplits = append(signedSplits, signedSplit)
 	}
-	signedModifedApk := "signed_" + modifiedApk
-	// Step 6: Sign the APK
-	log.Println("Signing APK...")
-	signCmd := exec.Command("jarsigner", "-keystore", keystore, "-storepass", keystorePassword, "-keypass", keyPassword, "-signedjar", signedModifedApk, modifiedApk, keyAlias)
-	log.Println(signCmd.Args)
-
-	signCmd.Stdout = os.Stdout
-	signCmd.Stderr = os.Stderr
-	if err := signCmd.Run(); err != nil {
-		log.Println("Error signing APK:", err)
-		return err
+	report.Outputs = append([]string{signedModifedApk}, signedSplits...)
+	if digest, err := signerCertDigest(opts); err != nil {
+		slog.Warn("Error reading signer certificate", "error", err)
+	} else {
+		report.SignerSHA256 = digest
 	}
 
-	log.Println("APK modified, rebuilt, and signed successfully:  " + signedModifedApk)
+	slog.Info("APK modified, rebuilt, and signed successfully", "output", signedModifedApk)
+	if opts.SkipInstall {
+		return report, nil
+	}
 
-	device, err := getConnectedDevice()
-	if err == nil && device != "" {
-		log.Println("检测到设备:", device)
-		err = uninstallAPK(device, m.Package)
-		if err != nil {
-			fmt.Println("Uninstall Error:", err)
+	// 批量运行时各个任务共用设备，一次只安装和启动一个
+	deviceMu.Lock()
+	defer deviceMu.Unlock()
+	report.startStage(stageDevice)
+	device, err := getTargetDevice(ctx)
+	// 由本工具启动的模拟器在结束后关闭，除非还在输出 logcat
+	defer func() {
+		if !runningProfile().Emulator.KeepRunning && !logcatActive() {
+			shutdownStartedEmulators()
 		}
-
-		// 安装新的 APK
-		log.Println("安装新的 APK...")
-		err = installAPK(device, signedModifedApk)
-		if err != nil {
-			log.Println("Error:", err)
-			return err
-		}
-		log.Println("已经安装新的 APK...")
-		// 启动应用
-		fmt.Println("启动应用...")
-		err = startApp(device, m.Package, m.Activity.Name)
-		if err != nil {
-			log.Println("启动应用 Error:", err)
-			return err
+	}()
+	if err != nil {
+		slog.Error("Error preparing device", "error", err)
+		if runningProfile().Emulator.AVD != "" {
+			return report, stageFailed(stageDevice, err)
 		}
-		fmt.Println("APK 安装并启动完成。")
-	} else {
-		log.Println("没有检测到设备，请手动安装:", signedModifedApk)
 	}
-	return nil
+	if err != nil || device == "" {
+		slog.Warn(T("noDeviceInstallManually", Args{"apk": signedModifedApk}))
+		return report, nil
+	}
+	return report, deployAPK(ctx, report, device, m, report.Outputs)
 }
 
-func checkDependencies() []string {
-	dependencies := []string{"apktool", "keytool", "jarsigner"}
-	missingDeps := []string{}
-
-	for _, dep := range dependencies {
-		if !isCommandAvailable(dep) {
-			missingDeps = append(missingDeps, dep)
-		}
+// deployAPK replaces the app on the device with the given APKs, base APK
+// first, then launches it.
+func deployAPK(ctx context.Context, report *runReport, device string, m manifest, apks []string) error {
+	slog.Info(T("deviceDetected", Args{"device": device}), "device", device)
+	report.Device = device
+	report.startStage(stageInstall)
+	err := uninstallAPK(ctx, device, m.Package)
+	if err != nil {
+		slog.Warn("Error uninstalling", "package", m.Package, "error", err)
 	}
 
-	return missingDeps
-}
-
-func isCommandAvailable(name string) bool {
-	cmd := exec.Command("which", name)
-	if runtime.GOOS == "windows" {
-		cmd = exec.Command("where", name)
+	// 安装新的 APK
+	slog.Info(T("installingAPKs", Args{"count": len(apks)}), "apks", apks)
+	if len(apks) > 1 {
+		err = installAPKs(ctx, device, apks)
+	} else {
+		err = installAPK(ctx, device, apks[0])
 	}
-	if err := cmd.Run(); err != nil {
-		return false
+	if err != nil {
+		slog.Error("Error installing APKs", "error", err)
+		return stageFailed(stageInstall, err)
 	}
-	return true
-}
-
-func isTTY() bool {
-	fileInfo, err := os.Stdout.Stat()
+	slog.Info(T("apksInstalled", Args{"count": len(apks)}))
+	applyPostInstall(device, m, runningProfile().PostInstall)
+	// 启动应用
+	slog.Info(T("launchingApp", Args{"package": m.Package}), "package", m.Package)
+	report.startStage(stageLaunch)
+	since, err := getDeviceTime(device)
 	if err != nil {
-		return false
+		// 读不到设备时间时先清空日志，检查崩溃时只读到这次启动的日志
+		slog.Warn("Error reading device time", "error", err)
+		if err := clearCrashLog(device); err != nil {
+			slog.Warn("Error clearing crash log", "error", err)
+		}
 	}
-	return (fileInfo.Mode() & os.ModeCharDevice) != 0
-}
-
-func loadLanguageFiles() (map[string]map[string]string, error) {
-	languages := []string{"en", "zh", "zh-TW", "ja", "ko"}
-	translations := make(map[string]map[string]string)
-
-	for _, lang := range languages {
-		content, err := ioutil.ReadFile(fmt.Sprintf("%s.yaml", lang))
+	err = startApp(ctx, device, m.Package, m.mainActivity())
+	if err != nil {
+		slog.Error(T("launchFailed", Args{"error": err}))
+		return stageFailed(stageLaunch, err)
+	}
+	if !runningProfile().Launch.SkipVerify {
+		crash, err := verifyLaunch(ctx, device, m.Package, since, runningProfile().Launch)
 		if err != nil {
-			fmt.Println("can not load lang file, use bundled one", lang)
-			switch lang {
-			case "zh":
-				content = resourceZhYaml.Content()
-			case "zh-TW":
-				content = resourceZhTWYaml.Content()
-			case "ja":
-				content = resourceJaYaml.Content()
-			case "ko":
-				content = resourceKoYaml.Content()
-
-			case "en":
-				fallthrough
-			default:
-
-				content = resourceEnYaml.Content()
+			slog.Error("Error verifying launch", "error", err)
+			if ctx.Err() != nil {
+				return stageFailed(stageLaunch, ctx.Err())
 			}
-			// return nil, err
 		}
-
-		var translation map[string]string
-		if err := yaml.Unmarshal(content, &translation); err != nil {
-			return nil, err
+		if crash != nil {
+			report.Crash = crash
+			for _, line := range strings.Split(strings.TrimSpace(crash.String()), "\n") {
+				logAlert(line)
+			}
+			if path, err := saveCrashReport(report.dir, crash); err != nil {
+				slog.Error("Error saving crash report", "error", err)
+			} else {
+				slog.Info("Crash report saved", "path", path)
+			}
+			return stageFailed(stageLaunch, fmt.Errorf("%s crashed after launch", m.Package))
 		}
-		translations[lang] = translation
-	}
-
-	return translations, nil
-}
-
-func getSystemLanguage() string {
-	lang := os.Getenv("LANG")
-	if lang == "" {
-		lang = os.Getenv("LC_ALL")
-	}
-	if lang == "" {
-		lang = os.Getenv("LC_MESSAGES")
 	}
-	if lang == "" {
-		lang = os.Getenv("LANGUAGE")
-	}
-
-	if lang == "" {
-		return "en"
+	slog.Info(T("installedAndLaunched"))
+	if runningProfile().Logcat.Enabled {
+		if err := followLogcat(device, m.Package, runningProfile().Logcat); err != nil {
+			slog.Error("Error streaming logcat", "error", err)
+		}
 	}
-
-	lang = strings.Split(lang, ".")[0]
-	lang = strings.Split(lang, "_")[0]
-
-	return lang
+	return nil
 }
 
-type Config struct {
-	Language string `yaml:"language"`
-}
+// The passwords are passed to keytool, jarsigner and apksigner in the
+// environment, arguments are visible to other processes and end up in logs.
+const (
+	storePassEnv = "APICKER_SIGN_STOREPASS"
+	keyPassEnv   = "APICKER_SIGN_KEYPASS"
+)
 
-func getConfigFilePath() string {
-	homeDir, _ := os.UserHomeDir()
-	configDir := filepath.Join(homeDir, ".config")
-	if _, err := os.Stat(configDir); os.IsNotExist(err) {
-		os.Mkdir(configDir, 0755)
-	}
-	return filepath.Join(configDir, "apicker.yml")
+// withPasswords adds the passwords of opts to the environment of cmd.
+func withPasswords(cmd *exec.Cmd, opts patchOptions) *exec.Cmd {
+	cmd.Env = append(os.Environ(), storePassEnv+"="+opts.KeystorePassword, keyPassEnv+"="+opts.KeyPassword)
+	return cmd
 }
 
-var config Config
-
-func loadConfig() (err error) {
-	configFilePath := getConfigFilePath()
-
-	if _, err = os.Stat(configFilePath); os.IsNotExist(err) {
-		return
+// ensureKeystore generates the keystore when it does not exist yet and checks
+// that it can be opened with the given password.
+func ensureKeystore(ctx context.Context, opts patchOptions) error {
+	if _, err := os.Stat(opts.Keystore); os.IsNotExist(err) {
+		slog.Info("Keystore not found, generating a new one", "keystore", opts.Keystore)
+		keytoolCmd := withPasswords(toolCommandContext(ctx, "keytool", "-genkeypair", "-v", "-storetype", "JKS", "-keystore", opts.Keystore, "-storepass:env", storePassEnv, "-keypass:env", keyPassEnv, "-alias", opts.KeyAlias, "-keyalg", "RSA", "-keysize", "2048", "-validity", "10000", "-dname", opts.DName), opts)
+		if err := runLogged(keytoolCmd, stageSign); err != nil {
+			slog.Error("Error generating keystore", "error", err)
+			return err
+		}
 	}
-
-	content, err := ioutil.ReadFile(configFilePath)
-	if err != nil {
-		return
+	checkKeyCmd := withPasswords(toolCommandContext(ctx, "keytool", "-list", "-v", "-keystore", opts.Keystore, "-storepass:env", storePassEnv), opts)
+	slog.Info("Running command", "args", redactArgs(checkKeyCmd.Args))
+	var checkKeyOutput bytes.Buffer
+	checkKeyCmd.Stdout = &checkKeyOutput
+	checkKeyCmd.Stderr = &checkKeyOutput
+	if err := checkKeyCmd.Run(); err != nil {
+		// only show the output when it failed, it lists the whole certificate chain
+		toolOutput(stageSign, strings.TrimSpace(checkKeyOutput.String()))
+		slog.Error("Error checking keystore", "error", err)
+		return err
 	}
+	return nil
+}
 
-	if err = yaml.Unmarshal(content, &config); err != nil {
-		return
+// signAPK signs with jarsigner, without it the APK is aligned with zipalign
+// and signed with apksigner, which also adds the v2 signature.
+func signAPK(ctx context.Context, opts patchOptions, unsignedApk, signedApk string) error {
+	if _, _, err := findTool("jarsigner"); err != nil {
+		return signAPKWithApksigner(ctx, opts, unsignedApk, signedApk)
 	}
-
-	return
+	signCmd := withPasswords(toolCommandContext(ctx, "jarsigner", "-keystore", opts.Keystore, "-storepass:env", storePassEnv, "-keypass:env", keyPassEnv, "-signedjar", signedApk, unsignedApk, opts.KeyAlias), opts)
+	return runLogged(signCmd, stageSign)
 }
 
-func saveConfig() error {
-	configFilePath := getConfigFilePath()
-	content, err := yaml.Marshal(&config)
-	if err != nil {
+// signSplitAPK re-signs a split APK pulled from a device or taken from a
+// bundle. Its original signature is removed first, jarsigner would keep it
+// next to the new one and add no v2 signature, which install-multiple refuses.
+func signSplitAPK(ctx context.Context, opts patchOptions, splitApk, signedApk string) error {
+	strippedApk := signedApk + ".unsigned"
+	defer os.Remove(strippedApk)
+	if err := stripSignature(splitApk, strippedApk); err != nil {
 		return err
 	}
+	return signAPKWithApksigner(ctx, opts, strippedApk, signedApk)
+}
 
-	if err := ioutil.WriteFile(configFilePath, content, 0644); err != nil {
+func signAPKWithApksigner(ctx context.Context, opts patchOptions, unsignedApk, signedApk string) error {
+	// apksigner 要求先对齐，签名之后就不能再对齐了
+	alignedApk := signedApk + ".aligned"
+	defer os.Remove(alignedApk)
+	alignCmd := toolCommandContext(ctx, "zipalign", "-p", "-f", "4", unsignedApk, alignedApk)
+	if err := runLogged(alignCmd, stageSign); err != nil {
 		return err
 	}
+	signCmd := withPasswords(toolCommandContext(ctx, "apksigner", "sign", "--ks", opts.Keystore, "--ks-pass", "env:"+storePassEnv, "--key-pass", "env:"+keyPassEnv, "--ks-key-alias", opts.KeyAlias, "--v1-signing-enabled", "true", "--v2-signing-enabled", "true", "--out", signedApk, alignedApk), opts)
+	return runLogged(signCmd, stageSign)
+}
 
-	return nil
+func isTTY(f *os.File) bool {
+	fileInfo, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return (fileInfo.Mode() & os.ModeCharDevice) != 0
 }
 
+// myTheme is the dark default theme with a font that can show CJK text.
 type myTheme struct {
 	Name string
+	// font is nil when the default font is used
+	font fyne.Resource
 }
 
 var _ fyne.Theme = (*myTheme)(nil)
 
-// return bundled font resource
-func (*myTheme) Font(s fyne.TextStyle) fyne.Resource {
-	fontPaht, err := findfont.Find("FiraCode")
-	if err != nil {
-		panic(err)
-	}
-	fari, err := fyne.LoadResourceFromPath(fontPaht)
-	if err != nil {
-		panic(err)
-	}
-	defaultFont := theme.DefaultTheme().Font(s)
-	fmt.Println("font checking:::", defaultFont, s.Monospace, s.Bold, s.Italic)
-	if s.Monospace {
-		fmt.Println("getting Monospace")
-		return defaultFont
-	}
-	if s.Bold {
-		if s.Italic {
-			return defaultFont
-		}
-		return fari
-	}
-	if s.Italic {
-		return defaultFont
-	}
-	return fari
+// newMyTheme resolves the font once, configured is the font of the config.
+func newMyTheme(configured string) *myTheme {
+	return &myTheme{Name: "apicker", font: resolveFont(configured)}
+}
 
+func (t *myTheme) Font(s fyne.TextStyle) fyne.Resource {
+	// 等宽和斜体使用默认字体
+	if t.font == nil || s.Monospace || s.Italic {
+		return theme.DefaultTheme().Font(s)
+	}
+	return t.font
 }
 
 func (*myTheme) Color(n fyne.ThemeColorName, v fyne.ThemeVariant) color.Color {
-	return theme.DefaultTheme().Color(n, v)
+	return theme.DefaultTheme().Color(n, theme.VariantDark)
 }
 
 func (*myTheme) Icon(n fyne.ThemeIconName) fyne.Resource {
@@ -630,14 +1089,59 @@ func (*myTheme) Size(n fyne.ThemeSizeName) float32 {
 }
 
 type manifest struct {
-	Package  string `xml:"package,attr"`
-	Activity struct {
-		Name string `xml:"name,attr"`
-	} `xml:"application>activity"`
+	Package         string              `xml:"package,attr"`
+	Application     manifestApplication `xml:"application"`
+	UsesPermissions []usesPermission    `xml:"uses-permission"`
+}
+
+type manifestApplication struct {
+	Label                 string             `xml:"label,attr"`
+	Icon                  string             `xml:"icon,attr"`
+	NetworkSecurityConfig string             `xml:"networkSecurityConfig,attr"`
+	Activities            []manifestActivity `xml:"activity"`
+}
+
+type manifestActivity struct {
+	Name          string `xml:"name,attr"`
+	IntentFilters []struct {
+		Actions []struct {
+			Name string `xml:"name,attr"`
+		} `xml:"action"`
+		Categories []struct {
+			Name string `xml:"name,attr"`
+		} `xml:"category"`
+	} `xml:"intent-filter"`
+}
+
+type usesPermission struct {
+	Name string `xml:"name,attr"`
+}
+
+// mainActivity returns the launcher activity, or the first activity when none
+// is declared as launcher.
+func (m manifest) mainActivity() string {
+	for _, activity := range m.Application.Activities {
+		for _, filter := range activity.IntentFilters {
+			isMain, isLauncher := false, false
+			for _, action := range filter.Actions {
+				isMain = isMain || action.Name == "android.intent.action.MAIN"
+			}
+			for _, category := range filter.Categories {
+				isLauncher = isLauncher || category.Name == "android.intent.category.LAUNCHER"
+			}
+			if isMain && isLauncher {
+				return activity.Name
+			}
+		}
+	}
+	if len(m.Application.Activities) > 0 {
+		return m.Application.Activities[0].Name
+	}
+	return ""
 }
 
 func getConnectedDevice() (string, error) {
-	cmd := exec.Command("adb", "devices")
+	cmd := toolCommand("adb", "devices")
 	output, err := cmd.Output()
 	if err != nil {
 		return "", err
@@ -655,8 +1159,8 @@ func getConnectedDevice() (string, error) {
 	return "", nil
 }
 
-func uninstallAPK(device, packageName string) error {
-	cmd := exec.Command("adb", "-s", device, "uninstall", packageName)
+func uninstallAPK(ctx context.Context, device, packageName string) error {
+	cmd := toolCommandContext(ctx, "adb", "-s", device, "uninstall", packageName)
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
 	err := cmd.Run()
@@ -666,19 +1170,36 @@ func uninstallAPK(device, packageName string) error {
 	return nil
 }
 
-func installAPK(device, apkPath string) error {
-	cmd := exec.Command("adb", "-s", device, "install", "-r", apkPath)
+func installAPK(ctx context.Context, device, apkPath string) error {
+	cmd := toolCommandContext(ctx, "adb", "-s", device, "install", "-r", apkPath)
 	var stderr bytes.Buffer
-	cmd.Stderr = &stderr
+	output := &lineWriter{stage: stageInstall}
+	cmd.Stdout = output
+	cmd.Stderr = io.MultiWriter(&stderr, output)
+	err := cmd.Run()
+	output.Flush()
+	if err != nil {
+		return fmt.Errorf("install error: %v, %s", err, stderr.String())
+	}
+	return nil
+}
+
+func installAPKs(ctx context.Context, device string, apkPaths []string) error {
+	cmd := toolCommandContext(ctx, "adb", append([]string{"-s", device, "install-multiple", "-r"}, apkPaths...)...)
+	var stderr bytes.Buffer
+	output := &lineWriter{stage: stageInstall}
+	cmd.Stdout = output
+	cmd.Stderr = io.MultiWriter(&stderr, output)
 	err := cmd.Run()
+	output.Flush()
 	if err != nil {
 		return fmt.Errorf("install error: %v, %s", err, stderr.String())
 	}
 	return nil
 }
 
-func startApp(device, packageName, mainActivity string) error {
-	cmd := exec.Command("adb", "-s", device, "shell", "am", "start", "-n", fmt.Sprintf("%s/%s", packageName, mainActivity))
+func startApp(ctx context.Context, device, packageName, mainActivity string) error {
+	cmd := toolCommandContext(ctx, "adb", "-s", device, "shell", "am", "start", "-n", fmt.Sprintf("%s/%s", packageName, mainActivity))
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
 	err := cmd.Run()
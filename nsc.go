@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// buildNetworkSecurityConfig returns the network_security_config.xml of the
+// patched APK. The trust anchors apply to the domains, or to the whole app
+// when no domain is given.
+func buildNetworkSecurityConfig(domains, caResources []string, patch PatchSettings) string {
+	var anchors strings.Builder
+	anchors.WriteString("        <trust-anchors>\n")
+	anchors.WriteString("            <certificates src=\"system\" />\n")
+	if !patch.SkipUserCAs {
+		anchors.WriteString("            <certificates src=\"user\" />\n")
+	}
+	for _, ca := range caResources {
+		fmt.Fprintf(&anchors, "            <certificates src=\"@raw/%s\" />\n", ca)
+	}
+	anchors.WriteString("        </trust-anchors>\n")
+
+	var b strings.Builder
+	b.WriteString("<?xml version=\"1.0\" encoding=\"utf-8\"?>\n<network-security-config>\n")
+	if len(domains) > 0 {
+		fmt.Fprintf(&b, "    <domain-config cleartextTrafficPermitted=\"%t\">\n", !patch.DisableCleartext)
+		for _, domain := range domains {
+			b.WriteString("        <domain includeSubdomains=\"true\">")
+			xml.EscapeText(&b, []byte(domain))
+			b.WriteString("</domain>\n")
+		}
+		b.WriteString(anchors.String())
+		b.WriteString("    </domain-config>\n")
+	} else {
+		fmt.Fprintf(&b, "    <base-config cleartextTrafficPermitted=\"%t\">\n", !patch.DisableCleartext)
+		b.WriteString(anchors.String())
+		b.WriteString("    </base-config>\n")
+	}
+	b.WriteString("</network-security-config>")
+	return b.String()
+}
+
+// copyCAFiles copies the CA certificates into res/raw of the decoded APK and
+// returns their resource names.
+func copyCAFiles(decodedDir string, caFiles []string) ([]string, error) {
+	if len(caFiles) == 0 {
+		return nil, nil
+	}
+	rawDir := filepath.Join(decodedDir, "res", "raw")
+	if err := os.MkdirAll(rawDir, 0755); err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for i, caFile := range caFiles {
+		content, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		// resource names may only contain lowercase letters, digits and _
+		name := fmt.Sprintf("apicker_ca_%d", i)
+		if err := os.WriteFile(filepath.Join(rawDir, name+strings.ToLower(filepath.Ext(caFile))), content, 0644); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/feature/plural"
+	"golang.org/x/text/language"
+)
+
+// pluralForms are the names of the plural forms in the translation files.
+var pluralForms = map[plural.Form]string{
+	plural.Zero: "zero",
+	plural.One:  "one",
+	plural.Two:  "two",
+	plural.Few:  "few",
+	plural.Many: "many",
+}
+
+// pluralCategory returns the CLDR plural category of count in lang: zero,
+// one, two, few, many or other. Values that are not numbers are "other".
+func pluralCategory(lang string, count interface{}) string {
+	tag, err := language.Parse(lang)
+	if err != nil {
+		return "other"
+	}
+	digits, ok := pluralDigits(count)
+	if !ok {
+		return "other"
+	}
+	i, v, w, f, t := pluralOperands(digits)
+	if form, ok := pluralForms[plural.Cardinal.MatchPlural(tag, i, v, w, f, t)]; ok {
+		return form
+	}
+	return "other"
+}
+
+// pluralDigits formats the absolute value of count in decimal digits, ok is
+// false for values that are not numbers.
+func pluralDigits(count interface{}) (string, bool) {
+	var s string
+	switch v := count.(type) {
+	case int:
+		s = strconv.FormatInt(int64(v), 10)
+	case int32:
+		s = strconv.FormatInt(int64(v), 10)
+	case int64:
+		s = strconv.FormatInt(v, 10)
+	case uint:
+		s = strconv.FormatUint(uint64(v), 10)
+	case uint32:
+		s = strconv.FormatUint(uint64(v), 10)
+	case uint64:
+		s = strconv.FormatUint(v, 10)
+	case float64:
+		s = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return "", false
+	}
+	return strings.TrimPrefix(s, "-"), true
+}
+
+// pluralOperands returns the CLDR operands of a decimal number: the integer
+// digits, the number of fraction digits with and without trailing zeros and
+// the fraction digits with and without them. Large values are taken modulo
+// 10,000,000 as plural.MatchPlural allows.
+func pluralOperands(digits string) (i, v, w, f, t int) {
+	intPart, frac := digits, ""
+	if dot := strings.IndexByte(digits, '.'); dot >= 0 {
+		intPart, frac = digits[:dot], digits[dot+1:]
+	}
+	i = lastDigits(intPart)
+	v, f = len(frac), lastDigits(frac)
+	trimmed := strings.TrimRight(frac, "0")
+	w, t = len(trimmed), lastDigits(trimmed)
+	return i, v, w, f, t
+}
+
+// lastDigits returns the value of the last 7 digits of s.
+func lastDigits(s string) int {
+	if len(s) > 7 {
+		s = s[len(s)-7:]
+	}
+	n, _ := strconv.Atoi(s)
+	return n
+}
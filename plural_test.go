@@ -0,0 +1,60 @@
+package main
+
+import "testing"
+
+func TestPluralCategory(t *testing.T) {
+	for _, test := range []struct {
+		lang  string
+		count interface{}
+		want  string
+	}{
+		{"en", 0, "other"},
+		{"en", 1, "one"},
+		{"en-US", 1, "one"},
+		{"en", 2, "other"},
+		{"en", 1.5, "other"},
+		{"en", "1", "other"},
+		{"ru", 1, "one"},
+		{"ru", 21, "one"},
+		{"ru", 11, "many"},
+		{"ru", 2, "few"},
+		{"ru", 24, "few"},
+		{"ru", 12, "many"},
+		{"ru", 5, "many"},
+		{"ru", 0, "many"},
+		{"ru", 1.5, "other"},
+		{"ar", 0, "zero"},
+		{"ar", 1, "one"},
+		{"ar", 2, "two"},
+		{"ar", 3, "few"},
+		{"ar", 110, "few"},
+		{"ar", 11, "many"},
+		{"ar", 199, "many"},
+		{"ar", 100, "other"},
+		{"ar", 102, "other"},
+		{"zh", 0, "other"},
+		{"zh", 1, "other"},
+		{"zh-TW", 2, "other"},
+		{"ja", int64(1), "other"},
+		{"fr", 1.5, "one"},
+		{"pt", 0, "one"},
+		{"pt-PT", 0, "other"},
+		{"pt-PT", 1, "one"},
+		{"lt", 1, "one"},
+		{"lt", 11, "other"},
+		{"lt", 1.5, "many"},
+		{"lt", 3, "few"},
+		{"lv", 0, "zero"},
+		{"lv", 21, "one"},
+		{"ro", 2, "few"},
+		{"ro", 20, "other"},
+		{"he", 2, "two"},
+		{"ru", -21, "one"},
+		{"en", uint64(1), "one"},
+		{"xx-invalid-tag!", 1, "other"},
+	} {
+		if got := pluralCategory(test.lang, test.count); got != test.want {
+			t.Errorf("pluralCategory(%q, %v) = %q, want %q", test.lang, test.count, got, test.want)
+		}
+	}
+}
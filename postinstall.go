@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+)
+
+// PostInstallOptions describes what to do on the device once the patched APK
+// has been installed and before the app is launched.
+type PostInstallOptions struct {
+	GrantPermissions           []string          `yaml:"grantPermissions,omitempty"`
+	GrantDangerous             bool              `yaml:"grantDangerous,omitempty"`
+	DisableBatteryOptimization bool              `yaml:"disableBatteryOptimization,omitempty"`
+	AppOps                     map[string]string `yaml:"appOps,omitempty"`
+}
+
+func (o PostInstallOptions) enabled() bool {
+	return len(o.GrantPermissions) > 0 || o.GrantDangerous || o.DisableBatteryOptimization || len(o.AppOps) > 0
+}
+
+// applyPostInstall grants permissions and sets app-ops for an installed package.
+// Individual failures are logged and skipped, a permission that can not be
+// granted should not prevent the app from being launched.
+func applyPostInstall(device string, m manifest, opts PostInstallOptions) {
+	if !opts.enabled() {
+		return
+	}
+	permissions := append([]string{}, opts.GrantPermissions...)
+	if opts.GrantDangerous {
+		dangerous, err := getDangerousPermissions(device)
+		if err != nil {
+			slog.Warn("Error listing dangerous permissions", "error", err)
+		}
+		for _, p := range m.UsesPermissions {
+			if dangerous[p.Name] {
+				permissions = append(permissions, p.Name)
+			}
+		}
+	}
+	for _, permission := range uniqueStrings(permissions) {
+		slog.Info("Granting permission", "permission", permission)
+		if err := adbShell(device, "pm", "grant", m.Package, permission); err != nil {
+			slog.Warn("Error granting permission", "permission", permission, "error", err)
+		}
+	}
+
+	ops := make([]string, 0, len(opts.AppOps))
+	for op := range opts.AppOps {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	for _, op := range ops {
+		slog.Info("Setting app-op", "op", op, "mode", opts.AppOps[op])
+		if err := adbShell(device, "appops", "set", m.Package, op, opts.AppOps[op]); err != nil {
+			slog.Warn("Error setting app-op", "op", op, "error", err)
+		}
+	}
+
+	if opts.DisableBatteryOptimization {
+		slog.Info("Disabling battery optimizations", "package", m.Package)
+		if err := adbShell(device, "dumpsys", "deviceidle", "whitelist", "+"+m.Package); err != nil {
+			slog.Warn("Error disabling battery optimizations", "error", err)
+		}
+	}
+}
+
+// getDangerousPermissions returns the set of permissions the device considers
+// dangerous, i.e. the ones that need a runtime grant.
+func getDangerousPermissions(device string) (map[string]bool, error) {
+	cmd := toolCommand("adb", "-s", device, "shell", "pm", "list", "permissions", "-g", "-d")
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	permissions := make(map[string]bool)
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "permission:") {
+			permissions[strings.TrimPrefix(line, "permission:")] = true
+		}
+	}
+	return permissions, nil
+}
+
+func adbShell(device string, args ...string) error {
+	cmd := toolCommand("adb", append([]string{"-s", device, "shell"}, args...)...)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v, %s", err, strings.TrimSpace(out.String()))
+	}
+	// pm and appops report some failures on stdout with a zero exit code
+	if msg := strings.TrimSpace(out.String()); strings.Contains(msg, "Exception") || strings.HasPrefix(msg, "Error") {
+		return fmt.Errorf("%s", msg)
+	}
+	return nil
+}
+
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool)
+	result := []string{}
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if v == "" || seen[v] {
+			continue
+		}
+		seen[v] = true
+		result = append(result, v)
+	}
+	return result
+}
+
+// parseAppOps reads app-ops given as OP=mode separated by commas, like
+// "SYSTEM_ALERT_WINDOW=allow,RUN_IN_BACKGROUND=ignore".
+func parseAppOps(text string) (map[string]string, error) {
+	ops := map[string]string{}
+	for _, item := range uniqueStrings(strings.Split(text, ",")) {
+		parts := strings.SplitN(item, "=", 2)
+		op, mode := strings.TrimSpace(parts[0]), ""
+		if len(parts) == 2 {
+			mode = strings.TrimSpace(parts[1])
+		}
+		if op == "" || !containsString(appOpsModes, mode) {
+			return nil, errors.New(T("invalidAppOp", Args{"op": item, "modes": strings.Join(appOpsModes, ", ")}))
+		}
+		ops[op] = mode
+	}
+	return ops, nil
+}
+
+// formatAppOps writes the app-ops the way parseAppOps reads them, sorted.
+func formatAppOps(ops map[string]string) string {
+	items := make([]string, 0, len(ops))
+	for op, mode := range ops {
+		items = append(items, op+"="+mode)
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseAppOps(t *testing.T) {
+	for _, test := range []struct {
+		text string
+		want map[string]string
+		ok   bool
+	}{
+		{"", map[string]string{}, true},
+		{"SYSTEM_ALERT_WINDOW=allow", map[string]string{"SYSTEM_ALERT_WINDOW": "allow"}, true},
+		{" RUN_IN_BACKGROUND = ignore , SYSTEM_ALERT_WINDOW=allow,", map[string]string{"RUN_IN_BACKGROUND": "ignore", "SYSTEM_ALERT_WINDOW": "allow"}, true},
+		{"SYSTEM_ALERT_WINDOW", nil, false},
+		{"SYSTEM_ALERT_WINDOW=always", nil, false},
+		{"=allow", nil, false},
+	} {
+		got, err := parseAppOps(test.text)
+		if (err == nil) != test.ok || (test.ok && !reflect.DeepEqual(got, test.want)) {
+			t.Errorf("parseAppOps(%q) = %v, %v, want %v, ok %v", test.text, got, err, test.want, test.ok)
+		}
+		if test.ok {
+			if again, err := parseAppOps(formatAppOps(got)); err != nil || !reflect.DeepEqual(again, got) {
+				t.Errorf("parseAppOps(formatAppOps(%v)) = %v, %v", got, again, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// toolOutput receives the output of child processes line by line, the GUI
+// replaces it so the lines end up in the log area.
+var toolOutput = func(stage, line string) {
+	fmt.Fprintf(os.Stderr, "[%s] %s\n", stage, line)
+}
+
+// commandContext is exec.CommandContext that kills the whole process tree on
+// cancel, apktool and friends are wrapper scripts around java.
+func commandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	setProcessGroup(cmd)
+	return cmd
+}
+
+// lineWriter splits what is written to it into lines and passes each line to
+// the log file and to toolOutput, tagged with the stage.
+type lineWriter struct {
+	stage string
+	mu    sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf.Write(p)
+	for {
+		i := bytes.IndexByte(w.buf.Bytes(), '\n')
+		if i < 0 {
+			break
+		}
+		line := string(w.buf.Next(i + 1))
+		w.emit(line)
+	}
+	return len(p), nil
+}
+
+// Flush emits the last line when it did not end with a newline.
+func (w *lineWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.buf.Len() > 0 {
+		w.emit(w.buf.String())
+		w.buf.Reset()
+	}
+}
+
+func (w *lineWriter) emit(line string) {
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return
+	}
+	slog.Info(line, "stage", w.stage)
+	toolOutput(w.stage, line)
+}
+
+// redactArgs hides passwords given on the command line before the arguments
+// are logged.
+func redactArgs(args []string) string {
+	return redactLogLine(strings.Join(args, " "))
+}
+
+// runLogged runs the command with its stdout and stderr streamed line by line.
+func runLogged(cmd *exec.Cmd, stage string) error {
+	w := &lineWriter{stage: stage}
+	cmd.Stdout = w
+	cmd.Stderr = w
+	slog.Info("Running command", "args", redactArgs(cmd.Args))
+	err := cmd.Run()
+	w.Flush()
+	return err
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"time"
+)
+
+const maxRecentInputs = 10
+
+// RecentInput remembers an input file and the options it was patched with.
+// Passwords are not stored.
+type RecentInput struct {
+	Path      string    `yaml:"path"`
+	SplitAPKs []string  `yaml:"splitApks,omitempty"`
+	Package   string    `yaml:"package,omitempty"`
+	Domain    string    `yaml:"domain,omitempty"`
+	Keystore  string    `yaml:"keystore,omitempty"`
+	KeyAlias  string    `yaml:"keyAlias,omitempty"`
+	DName     string    `yaml:"dname,omitempty"`
+	UsedAt    time.Time `yaml:"usedAt"`
+}
+
+// label is how the entry is shown in the recent inputs list.
+func (r RecentInput) label() string {
+	if r.Package == "" {
+		return r.Path
+	}
+	return r.Package + " - " + r.Path
+}
+
+// apply copies the remembered options into opts.
+func (r RecentInput) apply(opts *patchOptions) {
+	opts.APKFile = r.Path
+	opts.SplitAPKs = r.SplitAPKs
+	opts.Domain = r.Domain
+	if r.Keystore != "" {
+		opts.Keystore = r.Keystore
+	}
+	if r.KeyAlias != "" {
+		opts.KeyAlias = r.KeyAlias
+	}
+	if r.DName != "" {
+		opts.DName = r.DName
+	}
+}
+
+// addRecentInput puts the run on top of the recent inputs and saves them, the
+// rest of the config file is left as it is.
+func addRecentInput(opts patchOptions, packageName string) error {
+	entry := RecentInput{
+		Path:      opts.APKFile,
+		SplitAPKs: opts.SplitAPKs,
+		Package:   packageName,
+		Domain:    opts.Domain,
+		Keystore:  opts.Keystore,
+		KeyAlias:  opts.KeyAlias,
+		DName:     opts.DName,
+		UsedAt:    time.Now(),
+	}
+	recent := []RecentInput{entry}
+	for _, r := range config.Recent {
+		if r.Path != entry.Path && len(recent) < maxRecentInputs {
+			recent = append(recent, r)
+		}
+	}
+	config.Recent = recent
+	return saveRecentInputs()
+}
+
+// findRecentInput returns the last run of the package.
+func findRecentInput(packageName string) (RecentInput, bool) {
+	for _, r := range config.Recent {
+		if r.Package == packageName {
+			return r, true
+		}
+	}
+	return RecentInput{}, false
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestAddRecentInputSavesOnlyRecent(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	savedConfig, savedReadOnly := config, configReadOnly
+	defer func() { config, configReadOnly = savedConfig, savedReadOnly }()
+	configReadOnly = false
+	config = Config{
+		ActiveProfile: defaultProfileName,
+		Profiles:      map[string]*Profile{defaultProfileName: {Keystore: "saved.jks"}},
+	}
+	if err := saveConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	// one-off options of a run only change the profile in memory
+	config.profile().Keystore = "oneoff.jks"
+	config.profile().Emulator.AVD = "oneoff"
+	opts := patchOptions{APKFile: "app.apk", Keystore: "oneoff.jks"}
+	if err := addRecentInput(opts, "com.example.app"); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(getConfigFilePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	onDisk, _, err := decodeConfig(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := onDisk.Profiles[defaultProfileName]
+	if p == nil || p.Keystore != "saved.jks" || p.Emulator.AVD != "" {
+		t.Errorf("saved profile = %+v, want the profile of the file", p)
+	}
+	if len(onDisk.Recent) != 1 || onDisk.Recent[0].Package != "com.example.app" || onDisk.Recent[0].Keystore != "oneoff.jks" {
+		t.Errorf("saved recent inputs = %+v", onDisk.Recent)
+	}
+}
+
+func TestApplyRecentInputKeepsGivenFlags(t *testing.T) {
+	recent := RecentInput{
+		Path:      "old.apk",
+		SplitAPKs: []string{"split_config.arm64_v8a.apk"},
+		Domain:    "old.example.com",
+		Keystore:  "old.jks",
+		KeyAlias:  "old",
+	}
+	for _, test := range []struct {
+		args []string
+		want patchOptions
+	}{
+		{
+			nil,
+			patchOptions{APKFile: "old.apk", SplitAPKs: recent.SplitAPKs, Domain: "old.example.com", Keystore: "old.jks", KeyAlias: "old"},
+		},
+		{
+			[]string{"-domain", "new.example.com", "-keyAlias", "new"},
+			patchOptions{APKFile: "old.apk", SplitAPKs: recent.SplitAPKs, Domain: "new.example.com", Keystore: "old.jks", KeyAlias: "new"},
+		},
+		{
+			[]string{"-keystore", "new.jks", "new.apk"},
+			patchOptions{APKFile: "new.apk", Domain: "old.example.com", Keystore: "new.jks", KeyAlias: "old"},
+		},
+		{
+			[]string{"-apk", "flag.apk", "arg.apk"},
+			patchOptions{APKFile: "flag.apk", Domain: "old.example.com", Keystore: "old.jks", KeyAlias: "old"},
+		},
+	} {
+		fs := newFlagSet("patch")
+		opts := patchOptions{Keystore: "profile.jks", KeyAlias: "profile"}
+		fs.StringVar(&opts.APKFile, "apk", "", "")
+		addPatchFlags(fs, &opts)
+		if err := fs.Parse(test.args); err != nil {
+			t.Fatal(err)
+		}
+		applyRecentInput(fs, &opts, recent)
+		if !reflect.DeepEqual(opts, test.want) {
+			t.Errorf("%q: options = %+v, want %+v", test.args, opts, test.want)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// runReport is the structured result of a run, it is written as JSON next to
+// the output.
+type runReport struct {
+	RunID        string   `json:"runId,omitempty"`
+	Input        string   `json:"input"`
+	InputSHA256  string   `json:"inputSha256,omitempty"`
+	SplitAPKs    []string `json:"splitApks,omitempty"`
+	Package      string   `json:"package,omitempty"`
+	VersionName  string   `json:"versionName,omitempty"`
+	VersionCode  string   `json:"versionCode,omitempty"`
+	Patches      []string `json:"patches,omitempty"`
+	Outputs      []string `json:"outputs,omitempty"`
+	SignerSHA256 string   `json:"signerSha256,omitempty"`
+	Device       string   `json:"device,omitempty"`
+	// WorkDir holds the decoded and patched APK until the next run
+	WorkDir     string        `json:"workDir,omitempty"`
+	Stages      []stageTiming `json:"stages"`
+	Crash       *crashReport  `json:"crash,omitempty"`
+	Success     bool          `json:"success"`
+	FailedStage string        `json:"failedStage,omitempty"`
+	Error       string        `json:"error,omitempty"`
+	StartedAt   time.Time     `json:"startedAt"`
+	FinishedAt  time.Time     `json:"finishedAt"`
+	ReportPath  string        `json:"-"`
+
+	// WorkFiles maps the patched manifest and network security config to
+	// their copies next to the report, which outlive the work directory
+	WorkFiles map[string]string `json:"workFiles,omitempty"`
+
+	current *stageTiming
+	onStage func(stage string)
+	// dir is where the outputs and the report are written, the working
+	// directory when empty
+	dir string
+}
+
+type stageTiming struct {
+	Name       string `json:"name"`
+	DurationMs int64  `json:"durationMs"`
+	Error      string `json:"error,omitempty"`
+
+	start time.Time
+}
+
+func newRunReport(input string) *runReport {
+	r := &runReport{RunID: currentRunID(), Input: input, StartedAt: time.Now(), Stages: []stageTiming{}}
+	if sum, err := fileSHA256(input); err == nil {
+		r.InputSHA256 = sum
+	}
+	return r
+}
+
+// startStage ends the running stage and starts timing the next one.
+func (r *runReport) startStage(name string) {
+	r.endStage(nil)
+	r.current = &stageTiming{Name: name, start: time.Now()}
+	if r.onStage != nil {
+		r.onStage(name)
+	}
+}
+
+func (r *runReport) endStage(err error) {
+	if r.current == nil {
+		return
+	}
+	r.current.DurationMs = time.Since(r.current.start).Milliseconds()
+	if err != nil {
+		r.current.Error = err.Error()
+	}
+	r.Stages = append(r.Stages, *r.current)
+	r.current = nil
+}
+
+// finish records the outcome of the run, err is the error the run ended with.
+func (r *runReport) finish(err error) {
+	r.endStage(err)
+	r.FinishedAt = time.Now()
+	r.Success = err == nil
+	if err != nil {
+		r.Error = err.Error()
+		var se *stageError
+		if errors.As(err, &se) {
+			r.FailedStage = se.Stage
+		}
+	}
+}
+
+func (r *runReport) setAPKInfo(info *apkInfo) {
+	r.Package = info.Package
+	r.VersionName = info.VersionName
+	r.VersionCode = info.VersionCode
+}
+
+// save writes the report next to the output, named after the package when it
+// is known and after the input otherwise.
+func (r *runReport) save() error {
+	name := r.Package
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(r.Input), filepath.Ext(r.Input))
+	}
+	r.ReportPath = filepath.Join(r.dir, fmt.Sprintf("%s_report.json", name))
+	r.copyWorkFiles(name)
+	content, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(r.ReportPath, content, 0644)
+}
+
+// reportWorkFiles are the files of the work directory kept with the report
+// for the diagnostics bundle.
+var reportWorkFiles = []string{"AndroidManifest.xml", "res/xml/network_security_config.xml"}
+
+// copyWorkFiles copies the reportWorkFiles that exist in the work directory
+// next to the report, prefixed with name.
+func (r *runReport) copyWorkFiles(name string) {
+	if r.WorkDir == "" {
+		return
+	}
+	for _, file := range reportWorkFiles {
+		content, err := ioutil.ReadFile(filepath.Join(r.WorkDir, filepath.FromSlash(file)))
+		if err != nil {
+			continue
+		}
+		copyName := fmt.Sprintf("%s_%s", name, path.Base(file))
+		if err := ioutil.WriteFile(filepath.Join(r.dir, copyName), content, 0644); err != nil {
+			slog.Warn("Error copying work file", "file", file, "error", err)
+			continue
+		}
+		if r.WorkFiles == nil {
+			r.WorkFiles = map[string]string{}
+		}
+		r.WorkFiles[file] = copyName
+	}
+}
+
+func (r *runReport) writeJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// signerCertDigest returns the SHA-256 digest of the signing certificate.
+func signerCertDigest(opts patchOptions) (string, error) {
+	output, err := withPasswords(toolCommand("keytool", "-exportcert", "-rfc", "-keystore", opts.Keystore, "-storepass:env", storePassEnv, "-alias", opts.KeyAlias), opts).Output()
+	if err != nil {
+		return "", err
+	}
+	block, _ := pem.Decode(output)
+	if block == nil {
+		return "", errors.New("no certificate in keytool output")
+	}
+	sum := sha256.Sum256(block.Bytes)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,43 @@
+package main
+
+// stages of a run, used to tell where a run failed
+const (
+	stageDecode  = "decode"
+	stagePatch   = "patch"
+	stageBuild   = "build"
+	stageSign    = "sign"
+	stageDevice  = "device"
+	stageInstall = "install"
+	stageLaunch  = "launch"
+)
+
+// pipelineStages lists the stages of modifyAPK in the order they run.
+var pipelineStages = []string{stageDecode, stagePatch, stageBuild, stageSign, stageDevice, stageInstall, stageLaunch}
+
+// stageProgress returns the share of the pipeline done when stage starts.
+func stageProgress(stage string) float64 {
+	for i, s := range pipelineStages {
+		if s == stage {
+			return float64(i) / float64(len(pipelineStages))
+		}
+	}
+	return 0
+}
+
+type stageError struct {
+	Stage string
+	Err   error
+}
+
+func (e *stageError) Error() string {
+	return e.Stage + ": " + e.Err.Error()
+}
+
+func (e *stageError) Unwrap() error {
+	return e.Err
+}
+
+// stageFailed wraps err with the stage it happened in.
+func stageFailed(stage string, err error) error {
+	return &stageError{Stage: stage, Err: err}
+}
@@ -0,0 +1,578 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed toolpins.yaml
+var toolPinsFile []byte
+
+// toolPin is a pinned version of a download that provides some of the tools.
+type toolPin struct {
+	Name    string `yaml:"name"`
+	Version string `yaml:"version"`
+	// Provides maps tool names to the file in the download that runs them
+	Provides  map[string]string `yaml:"provides"`
+	Downloads []toolDownload    `yaml:"downloads"`
+}
+
+type toolDownload struct {
+	// OS and Arch are the GOOS and GOARCH of the download, empty for any
+	OS     string `yaml:"os,omitempty"`
+	Arch   string `yaml:"arch,omitempty"`
+	URL    string `yaml:"url"`
+	SHA256 string `yaml:"sha256"`
+}
+
+var (
+	// managedTools are the paths of the tools in the cache, found once and
+	// again after a download
+	managedTools   map[string]string
+	managedToolsMu sync.Mutex
+)
+
+func loadToolPins() ([]toolPin, error) {
+	var pins []toolPin
+	if err := yaml.Unmarshal(toolPinsFile, &pins); err != nil {
+		return nil, fmt.Errorf("toolpins.yaml: %w", err)
+	}
+	return pins, nil
+}
+
+// toolCacheDir is where downloaded tools are kept, APICKER_CACHE_DIR or the
+// user cache directory.
+func toolCacheDir() string {
+	if dir := os.Getenv("APICKER_CACHE_DIR"); dir != "" {
+		return filepath.Join(dir, "tools")
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "apicker", "tools")
+}
+
+func (p toolPin) dir() string {
+	return filepath.Join(toolCacheDir(), p.Name+"-"+p.Version)
+}
+
+// download returns the download for this platform.
+func (p toolPin) download() (toolDownload, bool) {
+	for _, d := range p.Downloads {
+		if (d.OS == "" || d.OS == runtime.GOOS) && (d.Arch == "" || d.Arch == runtime.GOARCH) {
+			return d, true
+		}
+	}
+	return toolDownload{}, false
+}
+
+func (p toolPin) installed() bool {
+	info, err := os.Stat(p.dir())
+	return err == nil && info.IsDir()
+}
+
+// fileName is the name of the download in a bundle directory.
+func (d toolDownload) fileName() string {
+	if u, err := url.Parse(d.URL); err == nil {
+		return path.Base(u.Path)
+	}
+	return path.Base(d.URL)
+}
+
+// managedToolPath returns the path of the named tool in the cache, empty when
+// it was not downloaded.
+func managedToolPath(name string) string {
+	managedToolsMu.Lock()
+	defer managedToolsMu.Unlock()
+	if managedTools == nil {
+		managedTools = findManagedTools()
+	}
+	return managedTools[name]
+}
+
+func resetManagedTools() {
+	managedToolsMu.Lock()
+	managedTools = nil
+	managedToolsMu.Unlock()
+}
+
+func findManagedTools() map[string]string {
+	paths := make(map[string]string)
+	pins, err := loadToolPins()
+	if err != nil {
+		slog.Error("Error reading tool pins", "error", err)
+		return paths
+	}
+	for _, pin := range pins {
+		if !pin.installed() {
+			continue
+		}
+		for tool, file := range pin.Provides {
+			if path := findProvidedFile(pin.dir(), file); path != "" {
+				paths[tool] = path
+			}
+		}
+	}
+	return paths
+}
+
+// findProvidedFile looks for file in the extracted download, on Windows also
+// for the .exe and .bat of it.
+func findProvidedFile(dir, file string) string {
+	names := []string{file}
+	if runtime.GOOS == "windows" {
+		names = append(names, file+".exe", file+".bat")
+	}
+	found := ""
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || found != "" {
+			return nil
+		}
+		if !info.IsDir() && containsString(names, info.Name()) {
+			found = path
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return found
+}
+
+// isFetchable tells whether "apicker tools fetch" can provide the named tool
+// on this platform.
+func isFetchable(name string) bool {
+	pins, err := loadToolPins()
+	if err != nil {
+		return false
+	}
+	for _, pin := range pins {
+		if _, ok := pin.Provides[name]; ok {
+			_, ok := pin.download()
+			return ok
+		}
+	}
+	return false
+}
+
+// pinsProviding returns the names of the pins that provide the tools.
+func pinsProviding(tools []string) []string {
+	pins, err := loadToolPins()
+	if err != nil {
+		return nil
+	}
+	names := []string{}
+	for _, pin := range pins {
+		for _, tool := range tools {
+			if _, ok := pin.Provides[tool]; ok && !containsString(names, pin.Name) {
+				names = append(names, pin.Name)
+			}
+		}
+	}
+	return names
+}
+
+// selectPins returns the named pins, all of them without names.
+func selectPins(names []string) ([]toolPin, error) {
+	pins, err := loadToolPins()
+	if err != nil || len(names) == 0 {
+		return pins, err
+	}
+	selected := []toolPin{}
+	for _, name := range names {
+		found := false
+		for _, pin := range pins {
+			if pin.Name == name {
+				selected = append(selected, pin)
+				found = true
+			}
+		}
+		if !found {
+			return nil, errors.New(T("unknownToolPin", Args{"name": name}))
+		}
+	}
+	return selected, nil
+}
+
+// fetchTools puts the named pins into the cache, all of them without names.
+// The downloads are taken from the bundle directory when one is given,
+// otherwise they are downloaded. Pins already in the cache are skipped.
+func fetchTools(ctx context.Context, names []string, bundle string, progress func(string)) error {
+	pins, err := selectPins(names)
+	if err != nil {
+		return err
+	}
+	defer resetManagedTools()
+	for _, pin := range pins {
+		if pin.installed() {
+			progress(T("toolCached", Args{"name": pin.Name, "version": pin.Version}))
+			continue
+		}
+		d, ok := pin.download()
+		if !ok {
+			progress(T("noToolDownload", Args{"name": pin.Name, "platform": runtime.GOOS + "/" + runtime.GOARCH}))
+			continue
+		}
+		if err := installPin(ctx, pin, d, bundle, progress); err != nil {
+			return fmt.Errorf("%s %s: %w", pin.Name, pin.Version, err)
+		}
+		progress(T("toolInstalled", Args{"name": pin.Name, "version": pin.Version, "dir": pin.dir()}))
+	}
+	return nil
+}
+
+// installPin verifies the download and extracts it next to its final
+// directory, which it is then renamed to, so an interrupted download leaves
+// nothing behind that looks installed.
+func installPin(ctx context.Context, pin toolPin, d toolDownload, bundle string, progress func(string)) error {
+	if err := os.MkdirAll(toolCacheDir(), 0755); err != nil {
+		return err
+	}
+	archive, err := ioutil.TempFile(toolCacheDir(), "."+d.fileName()+".*")
+	if err != nil {
+		return err
+	}
+	archive.Close()
+	defer os.Remove(archive.Name())
+	if bundle != "" {
+		progress(T("copyingTool", Args{"name": pin.Name, "version": pin.Version, "path": filepath.Join(bundle, d.fileName())}))
+		err = copyVerified(filepath.Join(bundle, d.fileName()), archive.Name(), d.SHA256)
+	} else {
+		progress(T("downloadingTool", Args{"name": pin.Name, "version": pin.Version, "url": d.URL}))
+		err = downloadVerified(ctx, d.URL, archive.Name(), d.SHA256)
+	}
+	if err != nil {
+		return err
+	}
+
+	tmpDir, err := ioutil.TempDir(toolCacheDir(), "."+pin.Name+"-"+pin.Version+".*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := extractDownload(archive.Name(), d.fileName(), tmpDir); err != nil {
+		return err
+	}
+	for tool, file := range pin.Provides {
+		path := findProvidedFile(tmpDir, file)
+		if path == "" {
+			return errors.New(T("toolNotInDownload", Args{"tool": tool, "file": file}))
+		}
+		// zip 文件不一定带有可执行权限
+		if !strings.HasSuffix(path, ".jar") {
+			os.Chmod(path, 0755)
+		}
+	}
+	return os.Rename(tmpDir, pin.dir())
+}
+
+// bundleTools downloads the named pins into dir for machines without network
+// access, with allPlatforms for every platform instead of this one.
+func bundleTools(ctx context.Context, names []string, dir string, allPlatforms bool, progress func(string)) error {
+	pins, err := selectPins(names)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, pin := range pins {
+		downloads := pin.Downloads
+		if !allPlatforms {
+			d, ok := pin.download()
+			if !ok {
+				progress(T("noToolDownload", Args{"name": pin.Name, "platform": runtime.GOOS + "/" + runtime.GOARCH}))
+				continue
+			}
+			downloads = []toolDownload{d}
+		}
+		for _, d := range downloads {
+			dest := filepath.Join(dir, d.fileName())
+			if verifyFile(dest, d.SHA256) == nil {
+				continue
+			}
+			progress(T("downloadingTool", Args{"name": pin.Name, "version": pin.Version, "url": d.URL}))
+			if err := downloadVerified(ctx, d.URL, dest, d.SHA256); err != nil {
+				return fmt.Errorf("%s %s: %w", pin.Name, pin.Version, err)
+			}
+		}
+	}
+	return nil
+}
+
+// downloadVerified downloads url to dest, which is removed again when its
+// checksum is not the pinned one.
+func downloadVerified(ctx context.Context, rawURL, dest, sha string) error {
+	if sha == "" {
+		return errors.New(T("noToolChecksum", Args{"url": rawURL}))
+	}
+	actual, err := downloadFile(ctx, rawURL, dest)
+	if err == nil && !strings.EqualFold(actual, sha) {
+		err = errors.New(T("toolChecksumMismatch", Args{"file": rawURL, "expected": sha, "actual": actual}))
+	}
+	if err != nil {
+		os.Remove(dest)
+	}
+	return err
+}
+
+// downloadFile writes url to dest and returns its SHA-256 checksum.
+func downloadFile(ctx context.Context, rawURL, dest string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", rawURL, resp.Status)
+	}
+	f, err := os.Create(dest)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), resp.Body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// copyVerified copies a download of a bundle directory and checks it on the
+// way, so what is installed is what was checked.
+func copyVerified(src, dest, sha string) error {
+	if sha == "" {
+		return errors.New(T("noToolChecksum", Args{"url": src}))
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(out, h), in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(actual, sha) {
+		return errors.New(T("toolChecksumMismatch", Args{"file": src, "expected": sha, "actual": actual}))
+	}
+	return nil
+}
+
+func verifyFile(path, sha string) error {
+	if sha == "" {
+		return errors.New(T("noToolChecksum", Args{"url": path}))
+	}
+	return copyVerified(path, os.DevNull, sha)
+}
+
+// extractDownload unpacks a .zip or .tar.gz download into dir, other files,
+// like apktool.jar, are copied into it as they are.
+func extractDownload(archive, name, dir string) error {
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return extractZip(archive, dir)
+	case strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz"):
+		return extractTarGz(archive, dir)
+	}
+	content, err := ioutil.ReadFile(archive)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, name), content, 0644)
+}
+
+// extractPath returns where an archive entry goes, entries that would end up
+// outside of dir are refused.
+func extractPath(dir, name string) (string, error) {
+	target := filepath.Join(dir, filepath.FromSlash(name))
+	if target != dir && !strings.HasPrefix(target, dir+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s: entry outside of the archive", name)
+	}
+	return target, nil
+}
+
+func extractZip(archive, dir string) error {
+	r, err := zip.OpenReader(archive)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	for _, f := range r.File {
+		target, err := extractPath(dir, f.Name)
+		if err != nil {
+			return err
+		}
+		if f.FileInfo().IsDir() {
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		in, err := f.Open()
+		if err != nil {
+			return err
+		}
+		err = writeExtracted(target, in, f.Mode())
+		in.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractTarGz(archive, dir string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		target, err := extractPath(dir, header.Name)
+		if err != nil {
+			return err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := writeExtracted(target, tr, header.FileInfo().Mode()); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			// 只保留指向归档内部的链接，macOS 的 JRE 里有这种链接
+			if _, err := extractPath(dir, path.Join(path.Dir(header.Name), header.Linkname)); err != nil || filepath.IsAbs(header.Linkname) {
+				continue
+			}
+			os.MkdirAll(filepath.Dir(target), 0755)
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func writeExtracted(target string, r io.Reader, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm()|0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, r)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// pinToolChecksums downloads every URL of the pins file at path and records
+// its checksum, the comments of the file are kept. It is run by the
+// maintainers after changing a pinned version.
+func pinToolChecksums(ctx context.Context, pinsPath string, progress func(string)) error {
+	content, err := ioutil.ReadFile(pinsPath)
+	if err != nil {
+		return err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(content, &doc); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile("", "apicker-pin-*")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	var pin func(n *yaml.Node) error
+	pin = func(n *yaml.Node) error {
+		if n.Kind == yaml.MappingNode {
+			var urlNode, shaNode *yaml.Node
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				switch n.Content[i].Value {
+				case "url":
+					urlNode = n.Content[i+1]
+				case "sha256":
+					shaNode = n.Content[i+1]
+				}
+			}
+			if urlNode != nil && shaNode != nil {
+				progress(T("downloadingFile", Args{"url": urlNode.Value}))
+				sha, err := downloadFile(ctx, urlNode.Value, tmp.Name())
+				if err != nil {
+					return err
+				}
+				shaNode.Value, shaNode.Style = sha, yaml.DoubleQuotedStyle
+				return nil
+			}
+		}
+		for _, child := range n.Content {
+			if err := pin(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := pin(&doc); err != nil {
+		return err
+	}
+	var out strings.Builder
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&doc); err != nil {
+		return err
+	}
+	return writeFileAtomic(pinsPath, []byte(out.String()), 0644)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+var sha256Pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// TestToolPinsHaveChecksums keeps pins without a checksum from being
+// released, their downloads are refused. Run "make tool-pins" to record them.
+func TestToolPinsHaveChecksums(t *testing.T) {
+	pins, err := loadToolPins()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pins) == 0 {
+		t.Fatal("toolpins.yaml has no pins")
+	}
+	for _, pin := range pins {
+		if len(pin.Provides) == 0 {
+			t.Errorf("%s %s: provides no tools", pin.Name, pin.Version)
+		}
+		for _, d := range pin.Downloads {
+			if !sha256Pattern.MatchString(d.SHA256) {
+				t.Errorf("%s %s: %s has no SHA-256 checksum, run make tool-pins", pin.Name, pin.Version, d.URL)
+			}
+		}
+	}
+}
+
+func TestExtractPathRefusesEscapes(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		ok   bool
+	}{
+		{"jdk/bin/java", true},
+		{"./jdk/lib", true},
+		{"../evil", false},
+		{"jdk/../../evil", false},
+	} {
+		_, err := extractPath("/cache/tmp", test.name)
+		if (err == nil) != test.ok {
+			t.Errorf("extractPath(%q) error %v, want ok %v", test.name, err, test.ok)
+		}
+	}
+}
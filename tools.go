@@ -0,0 +1,436 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// toolSpec describes an external tool apicker runs.
+type toolSpec struct {
+	Name string
+	// Required tools are needed to patch an APK, runs do not start without them
+	Required bool
+	// Alternatives stand in for a missing required tool
+	Alternatives []string
+	// VersionArgs make the tool print its version, tools without them are only
+	// looked up
+	VersionArgs []string
+	// version finds the version in the output of VersionArgs
+	version func(output string) string
+	// MinVersion is the oldest version known to work
+	MinVersion string
+	// dirs are searched before the PATH, like JAVA_HOME/bin
+	dirs func() []string
+}
+
+var toolSpecs = []toolSpec{
+	{Name: "apktool", Required: true, VersionArgs: []string{"--version"}, version: versionMatch(`(\d+\.\d+\.\d+)`), MinVersion: "2.7.0"},
+	{Name: "java", Required: true, VersionArgs: []string{"-version"}, version: javaVersion, MinVersion: "8", dirs: javaDirs},
+	{Name: "keytool", Required: true, dirs: javaDirs},
+	// the JRE downloaded by "apicker tools fetch" has no jarsigner, apksigner
+	// signs instead
+	{Name: "jarsigner", Required: true, Alternatives: []string{"apksigner", "zipalign"}, dirs: javaDirs},
+	{Name: "adb", VersionArgs: []string{"version"}, version: versionMatch(`Version (\d+\.\d+\.\d+)`), MinVersion: "30.0.0", dirs: sdkDirs("platform-tools")},
+	{Name: "apksigner", VersionArgs: []string{"--version"}, version: versionMatch(`(\d+\.\d+(?:\.\d+)?)`), dirs: buildToolsDirs},
+	{Name: "zipalign", dirs: buildToolsDirs},
+	// the emulator of the SDK comes before the one in the PATH, which is often
+	// the deprecated tools/emulator wrapper
+	{Name: "emulator", dirs: sdkDirs("emulator")},
+}
+
+// Status of a tool as reported by the doctor.
+const (
+	toolOK             = "ok"
+	toolMissing        = "missing"
+	toolOutdated       = "outdated"
+	toolUnknownVersion = "unknownVersion"
+	toolBroken         = "broken"
+)
+
+// toolCheck is what the doctor found out about a tool.
+type toolCheck struct {
+	Name     string `json:"name"`
+	Required bool   `json:"required"`
+	Status   string `json:"status"`
+	Path     string `json:"path,omitempty"`
+	// Source tells how the tool was found: the config key, the environment
+	// variable of the directory or PATH
+	Source     string `json:"source,omitempty"`
+	Version    string `json:"version,omitempty"`
+	MinVersion string `json:"minVersion,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// failed tells whether the tool can not be run at all.
+func (c toolCheck) failed() bool {
+	return c.Status == toolMissing || c.Status == toolBroken
+}
+
+// needsFix tells whether the doctor shows how to fix the tool, a version it
+// can not read is not worth a fix.
+func (c toolCheck) needsFix() bool {
+	return c.Status != toolOK && c.Status != toolUnknownVersion
+}
+
+func (c toolCheck) statusText() string {
+	return T("toolStatus_"+c.Status, Args{"min": c.MinVersion})
+}
+
+func (c toolCheck) neededText() string {
+	if c.Required {
+		return T("toolRequired")
+	}
+	return T("toolOptional")
+}
+
+func lookupToolSpec(name string) toolSpec {
+	for _, spec := range toolSpecs {
+		if spec.Name == name {
+			return spec
+		}
+	}
+	return toolSpec{Name: name}
+}
+
+// path returns the configured path of the named tool.
+func (t ToolPaths) path(name string) string {
+	v := reflect.ValueOf(t)
+	for i := 0; i < v.NumField(); i++ {
+		if strings.Split(v.Type().Field(i).Tag.Get("yaml"), ",")[0] == name {
+			return v.Field(i).String()
+		}
+	}
+	return ""
+}
+
+// toolsFromSettings returns the tool paths of the "tools." settings.
+func toolsFromSettings(s settings) ToolPaths {
+	var tools ToolPaths
+	v := reflect.ValueOf(&tools).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := strings.Split(v.Type().Field(i).Tag.Get("yaml"), ",")[0]
+		if path, ok := s["tools."+name].(string); ok {
+			v.Field(i).SetString(path)
+		}
+	}
+	return tools
+}
+
+// findTool returns the path of the named tool and where it was found. A
+// configured path is used as it is, then the tools downloaded into the cache,
+// the directories of the tool and the PATH.
+func findTool(name string) (path, source string, err error) {
+	if configured := config.Tools.path(name); configured != "" {
+		source = "tools." + name
+		if !strings.ContainsAny(configured, `/\`) {
+			path, err = exec.LookPath(configured)
+			return path, source, err
+		}
+		_, err = os.Stat(configured)
+		return configured, source, err
+	}
+	if path := managedToolPath(name); path != "" {
+		return path, "cache", nil
+	}
+	spec := lookupToolSpec(name)
+	if spec.dirs != nil {
+		for _, dir := range spec.dirs() {
+			if path := executableIn(dir, name); path != "" {
+				return path, toolDirSource(dir), nil
+			}
+		}
+	}
+	path, err = exec.LookPath(name)
+	if err != nil {
+		return "", "", err
+	}
+	return path, "PATH", nil
+}
+
+// toolPath returns the path to run the named tool with, the name itself when
+// it is not found so the error of the command names the tool.
+func toolPath(name string) string {
+	path, _, _ := findTool(name)
+	if path == "" {
+		return name
+	}
+	return path
+}
+
+// toolCommand runs the named tool, a tool configured as a .jar, like
+// apktool.jar, is run with java -jar.
+func toolCommand(name string, args ...string) *exec.Cmd {
+	path, args := toolArgs(name, args)
+	return exec.Command(path, args...)
+}
+
+// toolCommandContext is toolCommand for commands that are cancelled with ctx.
+func toolCommandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
+	path, args := toolArgs(name, args)
+	return commandContext(ctx, path, args...)
+}
+
+func toolArgs(name string, args []string) (string, []string) {
+	path := toolPath(name)
+	if strings.EqualFold(filepath.Ext(path), ".jar") {
+		return toolPath("java"), append([]string{"-jar", path}, args...)
+	}
+	return path, args
+}
+
+// executableIn returns the path of the named tool in dir, on Windows with the
+// extensions of executables and scripts.
+func executableIn(dir, name string) string {
+	exts := []string{""}
+	if runtime.GOOS == "windows" {
+		exts = []string{".exe", ".bat", ".cmd"}
+	}
+	for _, ext := range exts {
+		path := filepath.Join(dir, name+ext)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path
+		}
+	}
+	return ""
+}
+
+// toolDirSource names the environment variable dir comes from.
+func toolDirSource(dir string) string {
+	for _, env := range []string{"JAVA_HOME", "ANDROID_HOME", "ANDROID_SDK_ROOT"} {
+		if home := os.Getenv(env); home != "" && strings.HasPrefix(dir, home) {
+			return env
+		}
+	}
+	return dir
+}
+
+func javaDirs() []string {
+	if home := os.Getenv("JAVA_HOME"); home != "" {
+		return []string{filepath.Join(home, "bin")}
+	}
+	return nil
+}
+
+// sdkDirs returns the dirs in the Android SDK of ANDROID_HOME and
+// ANDROID_SDK_ROOT.
+func sdkDirs(sub string) func() []string {
+	return func() []string {
+		dirs := []string{}
+		for _, sdk := range androidSDKs() {
+			dirs = append(dirs, filepath.Join(sdk, sub))
+		}
+		return dirs
+	}
+}
+
+// buildToolsDirs returns the build-tools of the Android SDK, newest first.
+func buildToolsDirs() []string {
+	dirs := []string{}
+	for _, sdk := range androidSDKs() {
+		versions, err := filepath.Glob(filepath.Join(sdk, "build-tools", "*"))
+		if err != nil {
+			continue
+		}
+		sort.Slice(versions, func(i, j int) bool {
+			return compareVersions(filepath.Base(versions[i]), filepath.Base(versions[j])) > 0
+		})
+		dirs = append(dirs, versions...)
+	}
+	return dirs
+}
+
+func androidSDKs() []string {
+	sdks := []string{}
+	for _, env := range []string{"ANDROID_HOME", "ANDROID_SDK_ROOT"} {
+		if sdk := os.Getenv(env); sdk != "" && !containsString(sdks, sdk) {
+			sdks = append(sdks, sdk)
+		}
+	}
+	return sdks
+}
+
+// requiredTools returns the tools needed to patch an APK and the extra ones,
+// like adb when the APK is pulled from a device.
+func requiredTools(extra ...string) []string {
+	names := []string{}
+	for _, spec := range toolSpecs {
+		if spec.Required {
+			names = append(names, spec.Name)
+		}
+	}
+	return withAlternatives(append(names, extra...))
+}
+
+// splitSigningTools sign split APKs, jarsigner can not replace their
+// signature.
+var splitSigningTools = []string{"apksigner", "zipalign"}
+
+// patchTools returns the tools a run with opts needs and the extra ones, runs
+// with split APKs need splitSigningTools.
+func patchTools(opts patchOptions, extra ...string) []string {
+	names := requiredTools(extra...)
+	if len(opts.SplitAPKs) > 0 || isBundleFile(opts.APKFile) {
+		names = append(names, splitSigningTools...)
+	}
+	return uniqueStrings(names)
+}
+
+// withAlternatives replaces the missing tools whose alternatives are all
+// there with them.
+func withAlternatives(names []string) []string {
+	result := []string{}
+	for _, name := range names {
+		spec := lookupToolSpec(name)
+		if len(spec.Alternatives) > 0 && len(missingTools([]string{name})) > 0 && len(missingTools(spec.Alternatives)) == 0 {
+			result = append(result, spec.Alternatives...)
+		} else {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+// missingTools returns the named tools that can not be found. Unlike the
+// doctor it does not run them, so it is cheap enough to call before a run.
+func missingTools(names []string) []string {
+	missing := []string{}
+	for _, name := range names {
+		if _, _, err := findTool(name); err != nil {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+// missingToolsError tells which tools are missing and where to find out how
+// to install them.
+func missingToolsError(missing []string) error {
+	return fmt.Errorf("%s %s\n%s", T("missingDependencies"), strings.Join(missing, " "), T("missingToolsHint"))
+}
+
+// runDoctor checks all tools, the named ones and the required tools must be
+// usable.
+func runDoctor(ctx context.Context, required ...string) []toolCheck {
+	required = requiredTools(required...)
+	checks := make([]toolCheck, len(toolSpecs))
+	var wg sync.WaitGroup
+	for i, spec := range toolSpecs {
+		wg.Add(1)
+		go func(i int, spec toolSpec) {
+			defer wg.Done()
+			checks[i] = checkTool(ctx, spec, containsString(required, spec.Name))
+		}(i, spec)
+	}
+	wg.Wait()
+	return checks
+}
+
+// checkTool looks up the tool and compares its version with the minimum.
+func checkTool(ctx context.Context, spec toolSpec, required bool) toolCheck {
+	check := toolCheck{Name: spec.Name, Required: required, MinVersion: spec.MinVersion}
+	path, source, err := findTool(spec.Name)
+	check.Path, check.Source = path, source
+	if err != nil {
+		check.Status = toolMissing
+		check.Error = err.Error()
+		return check
+	}
+	if len(spec.VersionArgs) == 0 {
+		check.Status = toolOK
+		return check
+	}
+	output, err := toolVersion(ctx, spec)
+	if err != nil {
+		check.Status = toolBroken
+		check.Error = err.Error()
+		return check
+	}
+	check.Version = spec.version(output)
+	switch {
+	case check.Version == "":
+		check.Status = toolUnknownVersion
+	case spec.MinVersion != "" && compareVersions(check.Version, spec.MinVersion) < 0:
+		check.Status = toolOutdated
+	default:
+		check.Status = toolOK
+	}
+	return check
+}
+
+// toolVersion returns what the tool printed for its version arguments, java
+// prints it to stderr.
+func toolVersion(ctx context.Context, spec toolSpec) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	output, err := toolCommandContext(ctx, spec.Name, spec.VersionArgs...).CombinedOutput()
+	if err != nil {
+		if len(output) > 0 {
+			return "", errors.New(strings.TrimSpace(lastLine(string(output))))
+		}
+		return "", err
+	}
+	return string(output), nil
+}
+
+func lastLine(s string) string {
+	s = strings.TrimSpace(s)
+	return s[strings.LastIndex(s, "\n")+1:]
+}
+
+func versionMatch(pattern string) func(string) string {
+	re := regexp.MustCompile(pattern)
+	return func(output string) string {
+		if m := re.FindStringSubmatch(output); m != nil {
+			return m[1]
+		}
+		return ""
+	}
+}
+
+var javaVersionPattern = regexp.MustCompile(`version "([^"]+)"`)
+
+// javaVersion reads java -version, Java 8 and older call themselves 1.8.
+func javaVersion(output string) string {
+	m := javaVersionPattern.FindStringSubmatch(output)
+	if m == nil {
+		return ""
+	}
+	return strings.TrimPrefix(m[1], "1.")
+}
+
+var versionNumberPattern = regexp.MustCompile(`\d+`)
+
+// compareVersions compares dotted versions by their numbers, so 2.10.0 is
+// newer than 2.9.1 and 17 newer than 8.0.292.
+func compareVersions(a, b string) int {
+	as := versionNumberPattern.FindAllString(a, -1)
+	bs := versionNumberPattern.FindAllString(b, -1)
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"sync"
+
+	"fyne.io/fyne/v2/data/binding"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+var (
+	// uiTexts holds a binding per translation key shown in the GUI, the widgets
+	// showing the text listen to it
+	uiTexts   = make(map[string]binding.String)
+	uiTextsMu sync.Mutex
+	// openDialogs are made again when the language changes
+	openDialogs   = make(map[*translatedDialog]bool)
+	openDialogsMu sync.Mutex
+)
+
+// uiText returns the binding of a translation key.
+func uiText(key string) binding.String {
+	uiTextsMu.Lock()
+	defer uiTextsMu.Unlock()
+	b, ok := uiTexts[key]
+	if !ok {
+		b = binding.NewString()
+		b.Set(T(key))
+		uiTexts[key] = b
+	}
+	return b
+}
+
+// refreshUITexts sets every bound text and the open dialogs to the current
+// language, after it was switched or the translations were reloaded.
+func refreshUITexts() {
+	uiTextsMu.Lock()
+	for key, b := range uiTexts {
+		b.Set(T(key))
+	}
+	uiTextsMu.Unlock()
+
+	openDialogsMu.Lock()
+	dialogs := make([]*translatedDialog, 0, len(openDialogs))
+	for d := range openDialogs {
+		dialogs = append(dialogs, d)
+	}
+	openDialogsMu.Unlock()
+	for _, d := range dialogs {
+		d.rebuild()
+	}
+}
+
+// textScope binds widgets to translation keys. release removes the bindings
+// once the widgets are gone, like the content of a closed dialog.
+type textScope struct {
+	mu     sync.Mutex
+	unbind []func()
+}
+
+// bind calls set with the translation of key now and whenever it changes.
+func (s *textScope) bind(key string, set func(text string)) {
+	b := uiText(key)
+	l := binding.NewDataListener(func() {
+		if text, err := b.Get(); err == nil {
+			set(text)
+		}
+	})
+	b.AddListener(l)
+	s.mu.Lock()
+	s.unbind = append(s.unbind, func() { b.RemoveListener(l) })
+	s.mu.Unlock()
+}
+
+func (s *textScope) release() {
+	s.mu.Lock()
+	unbind := s.unbind
+	s.unbind = nil
+	s.mu.Unlock()
+	for _, f := range unbind {
+		f()
+	}
+}
+
+func (s *textScope) label(key string) *widget.Label {
+	l := widget.NewLabel(T(key))
+	s.bind(key, l.SetText)
+	return l
+}
+
+func (s *textScope) button(key string, tapped func()) *widget.Button {
+	b := widget.NewButton(T(key), tapped)
+	s.bind(key, b.SetText)
+	return b
+}
+
+func (s *textScope) check(key string, changed func(bool)) *widget.Check {
+	c := widget.NewCheck(T(key), changed)
+	s.bind(key, c.SetText)
+	return c
+}
+
+func (s *textScope) placeholder(entry *widget.Entry, key string) {
+	entry.SetPlaceHolder(T(key))
+	s.bind(key, entry.SetPlaceHolder)
+}
+
+func (s *textScope) selectPlaceholder(sel *widget.Select, key string) {
+	sel.PlaceHolder = T(key)
+	s.bind(key, func(text string) {
+		sel.PlaceHolder = text
+		sel.Refresh()
+	})
+}
+
+// keyed returns a text whose translation key changes while the GUI runs,
+// like the stage of a run.
+func (s *textScope) keyed(set func(text string)) *textKey {
+	return &textKey{scope: s, set: set, bound: make(map[string]bool)}
+}
+
+// textKey shows the translation of its current key, an empty key shows no
+// text.
+type textKey struct {
+	scope *textScope
+	set   func(text string)
+
+	mu    sync.Mutex
+	key   string
+	args  []Args
+	bound map[string]bool
+}
+
+func (k *textKey) SetKey(key string, args ...Args) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.key, k.args = key, args
+	if key == "" {
+		k.set("")
+		return
+	}
+	if !k.bound[key] {
+		k.bound[key] = true
+		k.scope.bind(key, func(string) {
+			k.mu.Lock()
+			defer k.mu.Unlock()
+			// 监听器是异步调用的，键可能已经变了
+			if k.key == key {
+				k.set(T(key, k.args...))
+			}
+		})
+	}
+	k.set(T(key, args...))
+}
+
+// SetText shows text as it is, like a value read from an APK.
+func (k *textKey) SetText(text string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.key, k.args = "", nil
+	k.set(text)
+}
+
+// translatedDialog is made again in the new language while it is shown, fyne
+// can not change the title and buttons of a dialog. The content is kept so
+// what was entered stays.
+type translatedDialog struct {
+	texts    *textScope
+	build    func(callback func(bool)) dialog.Dialog
+	callback func(bool)
+
+	mu         sync.Mutex
+	current    dialog.Dialog
+	rebuilding bool
+}
+
+// showTranslatedDialog shows the dialog made by build, which passes callback
+// on to dialogs that have one. The bindings of texts are released once the
+// dialog is closed.
+func showTranslatedDialog(texts *textScope, build func(callback func(bool)) dialog.Dialog, callback func(bool)) {
+	d := &translatedDialog{texts: texts, build: build, callback: callback}
+	openDialogsMu.Lock()
+	openDialogs[d] = true
+	openDialogsMu.Unlock()
+	d.show()
+}
+
+func (d *translatedDialog) show() {
+	dlg := d.build(d.respond)
+	dlg.SetOnClosed(d.closed)
+	d.mu.Lock()
+	d.current = dlg
+	d.mu.Unlock()
+	dlg.Show()
+}
+
+func (d *translatedDialog) isRebuilding() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.rebuilding
+}
+
+func (d *translatedDialog) respond(response bool) {
+	if d.isRebuilding() || d.callback == nil {
+		return
+	}
+	d.callback(response)
+}
+
+func (d *translatedDialog) closed() {
+	if d.isRebuilding() {
+		return
+	}
+	openDialogsMu.Lock()
+	delete(openDialogs, d)
+	openDialogsMu.Unlock()
+	d.texts.release()
+}
+
+func (d *translatedDialog) rebuild() {
+	d.mu.Lock()
+	d.rebuilding = true
+	current := d.current
+	d.mu.Unlock()
+	current.Hide()
+	d.mu.Lock()
+	d.rebuilding = false
+	d.mu.Unlock()
+	d.show()
+}